@@ -0,0 +1,175 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+// cacheModes lists where the driver keeps the name resolution cache of the
+// scaleway-cli API package, instead of the ~/.scw-cache.db it shares with scw.
+var cacheModes = []string{"memory", "file"}
+
+const cacheFile = "scw-cache.db"
+
+var (
+	// lockTimeout bounds the wait for another driver process to release a
+	// lock, and lockStale the age after which a lock is deemed abandoned.
+	lockTimeout = 30 * time.Second
+	lockStale   = 2 * time.Minute
+)
+
+// resolverCache returns the cache of the driver, loading it from the machine
+// directory in file mode.
+func (d *Driver) resolverCache() (*scw.ScalewayCache, error) {
+	if d.cache != nil {
+		return d.cache, nil
+	}
+
+	cache := &scw.ScalewayCache{}
+	cache.Clear()
+	cache.Modified = false
+
+	if d.Cache == "file" {
+		cache.Path = d.ResolveStorePath(cacheFile)
+
+		unlock, err := lockFile(cache.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		data, err := ioutil.ReadFile(cache.Path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		case json.Unmarshal(data, cache) != nil:
+			log.Warnf("Ignoring the corrupted cache %s", cache.Path)
+			cache.Clear()
+		}
+	}
+
+	d.cache = cache
+	return cache, nil
+}
+
+// saveCache writes the cache to the machine directory in file mode, if it
+// changed.
+func (d *Driver) saveCache() error {
+	if d.cache == nil || d.cache.Path == "" {
+		return nil
+	}
+
+	d.cache.Lock.Lock()
+	defer d.cache.Lock.Unlock()
+
+	if !d.cache.Modified {
+		return nil
+	}
+
+	unlock, err := lockFile(d.cache.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := json.Marshal(d.cache)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(d.cache.Path), cacheFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), d.cache.Path); err != nil {
+		return err
+	}
+
+	d.cache.Modified = false
+	return nil
+}
+
+// cachedImage returns the id of the image named name, whatever its case, for
+// arch in the location of the driver, when the cache knows exactly one. The
+// API resolves the other names, and reports the ambiguous ones.
+func (d *Driver) cachedImage(name, arch string) (string, bool) {
+	if d.cache == nil {
+		return "", false
+	}
+
+	d.cache.Lock.Lock()
+	defer d.cache.Lock.Unlock()
+
+	var ids []string
+	for id, fields := range d.cache.Images {
+		if strings.EqualFold(fields[scw.CacheTitle], name) && fields[scw.CacheArch] == arch && fields[scw.CacheRegion] == d.location() {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) != 1 {
+		return "", false
+	}
+
+	return ids[0], true
+}
+
+// lockFile locks path against the other driver processes by creating
+// path.lock, and returns the function releasing the lock.
+func lockFile(path string) (func(), error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > lockStale {
+			log.Warnf("Removing the stale lock %s", lock)
+			os.Remove(lock)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for the lock %s", lock)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// cacheImage records in the cache the id name resolved to, so that later
+// resolutions skip the API.
+func (d *Driver) cacheImage(id, name, arch string) {
+	if d.cache != nil {
+		d.cache.InsertImage(id, d.location(), arch, "", name, "")
+	}
+}
@@ -0,0 +1,167 @@
+package scaleway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedCacheIgnored(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		// A stale entry of the scw cache would resolve the image to a bad id.
+		{"stale", `{"images": {"0a5c1c5e-4d29-4a4b-9a0c-6b2f6a0e9d11": ["ams1", "x86_64", "", "` + defaultImage + `", ""]}}` + "\n", 0600},
+		// The scw cache removes a file it cannot parse.
+		{"corrupt", `{"images": ` + "\n", 0600},
+		{"unreadable", `{"images": {}}` + "\n", 0},
+	} {
+		f := newFakeAPI()
+
+		shared := filepath.Join(f.dir, ".scw-cache.db")
+		writeFile(t, shared, tc.content)
+		if err := os.Chmod(shared, tc.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		td := f.newDriver()
+		if err := td.Create(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if image := f.server(td.ServerID).Image.Identifier; image != testImageID {
+			t.Errorf("%s: expecting image %s, got %s\n", tc.name, testImageID, image)
+		}
+
+		os.Chmod(shared, 0600)
+		if data, err := ioutil.ReadFile(shared); err != nil || string(data) != tc.content {
+			t.Errorf("%s: expecting ~/.scw-cache.db to be left alone, got '%s' (%v)\n", tc.name, data, err)
+		}
+
+		f.close()
+	}
+}
+
+func TestCacheModes(t *testing.T) {
+	for _, mode := range []string{"memory", "file"} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		td.Cache = mode
+		if err := td.PreCreateCheck(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The image resolved by PreCreateCheck is reused by Create.
+		if n := f.served("marketplace"); n != 1 {
+			t.Errorf("%s: expecting the images to be listed once, got %d\n", mode, n)
+		}
+
+		_, err := os.Stat(td.ResolveStorePath(cacheFile))
+		if (err == nil) != (mode == "file") {
+			t.Errorf("%s: unexpected cache file (%v)\n", mode, err)
+		}
+
+		c, err := reload(t, td).client()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = c.resolveImage(defaultImage, testArch); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 2
+		if mode == "file" {
+			expected = 1
+		}
+		if n := f.served("marketplace"); n != expected {
+			t.Errorf("%s: expecting the images to be listed %d times, got %d\n", mode, expected, n)
+		}
+
+		f.close()
+	}
+}
+
+func TestCachedImage(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	c, err := td.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cachedID = "6a7f5c3e-2b1d-4e8f-9c0a-1d2e3f4a5b6c"
+	td.cacheImage(cachedID, "Ubuntu-Xenial", testArch)
+	if id, err := c.resolveImage(defaultImage, testArch); err != nil || id != cachedID {
+		t.Errorf("Expecting the cached image %s whatever the case, got %s (%v)\n", cachedID, id, err)
+	}
+
+	// The API resolver reports the names the cache holds several times.
+	td.cacheImage("7b8a6d4f-3c2e-4f9a-8d1b-2e3f4a5b6c7d", "Ubuntu-Xenial", testArch)
+	if id, err := c.resolveImage(defaultImage, testArch); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("Expecting the image to be ambiguous, got %s (%v)\n", id, err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scaleway-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	timeout, stale := lockTimeout, lockStale
+	defer func() { lockTimeout, lockStale = timeout, stale }()
+	lockTimeout, lockStale = 200*time.Millisecond, time.Hour
+
+	path := filepath.Join(dir, cacheFile)
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = lockFile(path); err == nil {
+		t.Error("Expecting a held lock to time out")
+	}
+
+	release := unlock
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(released)
+		release()
+	}()
+
+	relock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-released:
+	default:
+		t.Error("Expecting the lock to wait for its release")
+	}
+	relock()
+
+	// An abandoned lock is taken over.
+	writeFile(t, path+".lock", "1\n")
+	lockStale = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	if unlock, err = lockFile(path); err != nil {
+		t.Fatalf("Expecting a stale lock to be removed, got %v\n", err)
+	}
+	unlock()
+}
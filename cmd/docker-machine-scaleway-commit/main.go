@@ -0,0 +1,97 @@
+// Command docker-machine-scaleway-commit turns a machine of the scaleway driver
+// into an image: it stops the server, snapshots its root volume and registers
+// an image of it, whose id it prints for --scaleway-image.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	scaleway "github.com/huseyin/docker-machine-driver-scaleway"
+)
+
+func main() {
+	storagePath := flag.String("storage-path", defaultStoragePath(), "docker-machine storage path")
+	name := flag.String("name", "", "image name, MACHINE-YYYYMMDD-HHMMSS by default")
+	debug := flag.Bool("debug", false, "enable debug output")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] MACHINE\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Stops MACHINE and commits its root volume into an image, whose id is printed.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Only the image id goes to stdout, so that it can be captured.
+	log.SetOutWriter(os.Stderr)
+	log.SetDebug(*debug)
+
+	d, err := loadDriver(*storagePath, flag.Arg(0))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if *name == "" {
+		*name = d.MachineName + "-" + time.Now().Format("20060102-150405")
+	}
+
+	id, err := d.Commit(*name)
+	if err != nil {
+		log.Errorf("Cannot commit %s: %v", d.MachineName, err)
+		os.Exit(1)
+	}
+
+	fmt.Println(id)
+}
+
+// defaultStoragePath returns the storage path docker-machine uses by default.
+func defaultStoragePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+
+	return filepath.Join(mcnutils.GetHomeDir(), ".docker", "machine")
+}
+
+// loadDriver reads the driver of the machine from its config.json.
+func loadDriver(storagePath, machine string) (*scaleway.Driver, error) {
+	data, err := ioutil.ReadFile(filepath.Join(storagePath, "machines", machine, "config.json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no machine %s in %s", machine, storagePath)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		DriverName string
+		Driver     json.RawMessage
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("cannot read the configuration of %s: %v", machine, err)
+	}
+
+	d := scaleway.NewDriver(machine, storagePath).(*scaleway.Driver)
+	if config.DriverName != d.DriverName() {
+		return nil, fmt.Errorf("%s is a %s machine, not a %s one", machine, config.DriverName, d.DriverName())
+	}
+
+	if err = json.Unmarshal(config.Driver, d); err != nil {
+		return nil, fmt.Errorf("cannot read the configuration of %s: %v", machine, err)
+	}
+
+	return d, nil
+}
@@ -1,53 +1,912 @@
 package scaleway
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/docker/docker/pkg/namesgenerator"
+	"github.com/docker/machine/libmachine/log"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/moul/anonuuid"
+	"github.com/renstrom/fuzzysearch/fuzzy"
 	scw "github.com/scaleway/scaleway-cli/pkg/api"
 )
 
+// dialSSH connects to the SSH port at addr. It is a variable so tests can
+// redirect the connection.
+var dialSSH = func(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, 5*time.Second)
+}
+
+// probeSSH checks that the SSH port at addr accepts connections. It is a
+// variable so the TCP probe can be replaced in tests.
+var probeSSH = func(addr string) error {
+	conn, err := dialSSH(addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// computeAPI is the part of scw.ScalewayAPI the client uses, which the legacy
+// and Instance API implementations mirror.
+type computeAPI interface {
+	CheckCredentials() error
+	GetQuotas() (*scw.ScalewayGetQuotas, error)
+	GetProductsServers() (*scw.ScalewayProductsServers, error)
+	GetImage(imageID string) (*scw.ScalewayImage, error)
+	GetImages() (*[]scw.MarketImage, error)
+	GetImageID(needle, arch string) (*scw.ScalewayImageIdentifier, error)
+	PostImage(volumeID, name, bootscript, arch string) (string, error)
+	GetBootscript(bootscriptID string) (*scw.ScalewayBootscript, error)
+	GetBootscripts() (*[]scw.ScalewayBootscript, error)
+	GetBootscriptID(needle, arch string) (string, error)
+	GetSnapshot(snapshotID string) (*scw.ScalewaySnapshot, error)
+	GetSnapshots() (*[]scw.ScalewaySnapshot, error)
+	PostSnapshot(volumeID, name string) (string, error)
+	GetServers(all bool, limit int) (*[]scw.ScalewayServer, error)
+	GetServer(serverID string) (*scw.ScalewayServer, error)
+	PostServer(definition scw.ScalewayServerDefinition) (string, error)
+	PatchServer(serverID string, definition scw.ScalewayServerPatchDefinition) error
+	PostServerAction(serverID, action string) error
+	DeleteServerForce(serverID string) error
+	PatchUserdata(serverID, key string, value []byte, metadata bool) error
+	GetSSHFingerprintFromServer(serverID string) []string
+	NewIP() (*scw.ScalewayGetIP, error)
+	GetIP(ipID string) (*scw.ScalewayGetIP, error)
+	GetIPS() (*scw.ScalewayGetIPS, error)
+	DeleteIP(ipID string) error
+	PostVolume(definition scw.ScalewayVolumeDefinition) (string, error)
+	PostVolumeFromSnapshot(snapshotID, name, volumeType string) (string, error)
+	GetVolume(volumeID string) (*scw.ScalewayVolume, error)
+	GetVolumes() (*[]scw.ScalewayVolume, error)
+	DeleteVolume(volumeID string) error
+	GetSecurityGroups() (*scw.ScalewayGetSecurityGroups, error)
+	PostSecurityGroup(group scw.ScalewayNewSecurityGroup) error
+	PostSecurityGroupRule(securityGroupID string, rule scw.ScalewayNewSecurityGroupRule) error
+	DeleteSecurityGroup(securityGroupID string) error
+	GetUser() (*scw.ScalewayUserDefinition, error)
+	PatchUserSSHKey(userID string, definition scw.ScalewayUserPatchSSHKeyDefinition) error
+}
+
+// bootTypeAPI is implemented by the APIs which can boot a server from its
+// local volume instead of a bootscript. The legacy API cannot.
+type bootTypeAPI interface {
+	PatchServerBootType(serverID, bootType string) error
+}
+
+// sshKeyAPI is implemented by the APIs which create and delete SSH keys one at
+// a time. The legacy API replaces the SSH keys of the user as a whole.
+type sshKeyAPI interface {
+	GetSSHKeys() ([]iamSSHKey, error)
+	PostSSHKey(pub string) error
+	DeleteSSHKey(keyID string) error
+}
+
+// machineClient is what the driver needs from the API to manage a machine.
+// client implements it on top of a computeAPI, which is where the API versions
+// plug in: legacyAPI and instanceAPI. The driver gets it from its
+// clientFactory, newClient by default. Both are unexported: the factory is a
+// seam for the tests of this package, which wrap or replace the client, and
+// other packages cannot inject one.
+type machineClient interface {
+	checkCredentials() error
+	checkQuotas(needed map[string]int) error
+	getOffer(commercialType string) (*scw.ProductServer, error)
+	resolveImage(name, arch string) (string, error)
+	resolveBootscript(name, arch string) (string, error)
+	resolveSnapshot(name string, offer *scw.ProductServer, volumes string) (*scw.ScalewaySnapshot, error)
+
+	createServer(config *scw.ConfigCreateServer, onVolume func(id string)) (string, error)
+	reserveIP() (*scw.ScalewayGetIP, error)
+	getServer() (*scw.ScalewayServer, error)
+	findServer() (*scw.ScalewayServer, error)
+	serverByName(name string) (*scw.ScalewayServer, error)
+	hostFingerprints() []string
+
+	startServer() error
+	rebootServer() error
+	stopServer() error
+	killServer(action string) error
+	terminateServer() error
+	waitForServerReady() error
+	waitForServerRemoval() error
+
+	snapshotServer(server *scw.ScalewayServer, name string) (map[string]*scw.ScalewaySnapshot, error)
+	commitServer(name string) (string, error)
+	removeServer(server *scw.ScalewayServer, stop bool) error
+	deleteServerAndVolumes() error
+	removeVolume(id string, wait bool) error
+	deleteVolume(id string) error
+	deleteIP(id string) error
+
+	securityGroupID(needle string) (string, error)
+	createSecurityGroup(name string, ports []groupPort) (string, error)
+	setSecurityGroup(id string) error
+	deleteSecurityGroup(id string) error
+
+	setLocalBoot() error
+	setUserdata(data map[string][]byte) ([]string, error)
+	tags() string
+
+	registerSSHKey(pub string) (bool, error)
+	deregisterSSHKey(pub string) error
+}
+
 type client struct {
-	api    *scw.ScalewayAPI
+	api    computeAPI
 	driver *Driver
 }
 
-func newClient(d *Driver) (*client, error) {
-	scwAPI, err := scw.NewScalewayAPI(d.Organization, d.Token, "", d.Region)
+// newClient talks to the zoned Instance API when the driver has a secret key,
+// and to the legacy regional API otherwise.
+func newClient(d *Driver) (machineClient, error) {
+	cache, err := d.resolverCache()
+	if err != nil {
+		return nil, err
+	}
+
+	if d.useInstanceAPI() {
+		return &client{newInstanceAPI(d.Zone, d.AccessKey, d.SecretKey, d.ProjectID), d}, nil
+	}
+
+	api, err := newLegacyAPI(d.Organization, d.Token, d.Region, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{api, d}, nil
+}
+
+// createServer creates a stopped server from config, where IP holds the id of a
+// reserved IP and ImageName may name a snapshot as snapshot:name. The
+// additional volumes are created first and their ids passed to onVolume, so
+// that they can be released if a later step fails.
+func (c *client) createServer(config *scw.ConfigCreateServer, onVolume func(id string)) (string, error) {
+	commercialType := serverCommercialType(config.CommercialType)
+	offer, err := c.getOffer(commercialType)
+	if err != nil {
+		return "", err
+	}
+	arch := targetArch(offer)
+
+	server := scw.ScalewayServerDefinition{
+		Name:              config.Name,
+		CommercialType:    strings.ToUpper(commercialType),
+		DynamicIPRequired: &config.DynamicIPRequired,
+		EnableIPV6:        config.EnableIPV6,
+		PublicIP:          config.IP,
+		Tags:              strings.Fields(config.Env),
+		Volumes:           make(map[string]string),
+	}
+
+	if server.Name == "" {
+		server.Name = strings.Replace(namesgenerator.GetRandomName(0), "_", "-", -1)
+	}
+
+	var snapshot *scw.ScalewaySnapshot
+	if name := strings.TrimPrefix(config.ImageName, "snapshot:"); name != config.ImageName {
+		if snapshot, err = c.resolveSnapshot(name, offer, config.AdditionalVolumes); err != nil {
+			return "", err
+		}
+	}
+
+	// The volumes of a snapshot must fit the offer without filling.
+	volumes := config.AdditionalVolumes
+	if volumes == "" && offer.VolumesConstraint.MinSize > 0 && snapshot == nil {
+		volumes = scw.VolumesFromSize(offer.VolumesConstraint.MinSize)
+	}
+
+	for i, size := range strings.Fields(volumes) {
+		id, err := c.createVolume(size)
+		if err != nil {
+			return "", err
+		}
+		onVolume(id)
+		server.Volumes[strconv.Itoa(i+1)] = id
+	}
+
+	blank := snapshot == nil && isVolumeSize(config.ImageName)
+	if snapshot == nil && !blank {
+		image, err := c.resolveImage(config.ImageName, arch)
+		if err != nil {
+			return "", err
+		}
+		server.Image = &image
+	}
+
+	if config.Bootscript != "" {
+		bootscript, err := c.resolveBootscript(config.Bootscript, arch)
+		if err != nil {
+			return "", err
+		}
+		server.Bootscript = &bootscript
+	}
+
+	switch {
+	case snapshot != nil:
+		if server.Volumes["0"], err = c.restoreSnapshot(snapshot, server.Name); err != nil {
+			return "", err
+		}
+	case blank:
+		if server.Volumes["0"], err = c.createVolume(config.ImageName); err != nil {
+			return "", err
+		}
+	}
+
+	var id string
+	err = retry("create the server", false, func() (err error) {
+		id, err = c.api.PostServer(server)
+		return err
+	})
+
+	// The restored or blank root volume is not passed to onVolume, whose
+	// volumes follow it, so it is removed here.
+	if err != nil && (snapshot != nil || blank) {
+		if derr := c.deleteVolume(server.Volumes["0"]); derr != nil {
+			log.Warnf("Cannot remove volume %s: %v", server.Volumes["0"], derr)
+		}
+	}
+
+	return id, err
+}
+
+// createVolume creates a blank volume of a human size such as 50G and returns
+// its id.
+func (c *client) createVolume(size string) (string, error) {
+	bytes, err := humanize.ParseBytes(size)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	err = retry("create a volume", false, func() (err error) {
+		id, err = c.api.PostVolume(scw.ScalewayVolumeDefinition{Name: size, Size: bytes, Type: "l_ssd"})
+		return err
+	})
+
+	return id, err
+}
+
+// isVolumeSize tells whether an image name is a human size, which stands for a
+// blank root volume of that size like with scw.
+func isVolumeSize(image string) bool {
+	_, err := humanize.ParseBytes(image)
+	return err == nil
+}
+
+// serverCommercialType returns the commercial type of the server, which
+// SCW_COMMERCIAL_TYPE overrides like with scw.
+func serverCommercialType(configured string) string {
+	if t := os.Getenv("SCW_COMMERCIAL_TYPE"); t != "" {
+		return t
+	}
+
+	return configured
+}
+
+// targetArch returns the architecture of the image and the bootscript, the one
+// of the offer unless SCW_TARGET_ARCH overrides it like with scw.
+func targetArch(offer *scw.ProductServer) string {
+	if arch := os.Getenv("SCW_TARGET_ARCH"); arch != "" {
+		return arch
+	}
+
+	return offer.Arch
+}
+
+// getOffer returns the product matching a commercial type or one of its
+// alternative names.
+func (c *client) getOffer(commercialType string) (*scw.ProductServer, error) {
+	var products *scw.ScalewayProductsServers
+	err := retry("fetch the server products", true, func() (err error) {
+		products, err = c.api.GetProductsServers()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch the server products: %v", err)
+	}
+
+	if offer, err := scw.OfferNameFromName(strings.ToUpper(commercialType), products); err == nil {
+		return offer, nil
+	}
+
+	var names []string
+	for name, offer := range products.Servers {
+		names = append(names, name)
+		names = append(names, offer.AltNames...)
+	}
+
+	return nil, fmt.Errorf("unknown commercial type %s%s", commercialType, suggest(commercialType, names))
+}
+
+// resolveImage returns the id of the image named name, or with this id, which
+// runs on arch in the region of the client.
+func (c *client) resolveImage(name, arch string) (string, error) {
+	if anonuuid.IsUUID(name) == nil {
+		var image *scw.ScalewayImage
+		err := retry("get image "+name, true, func() (err error) {
+			image, err = c.api.GetImage(name)
+			return err
+		})
+		if isNotFound(err) {
+			return "", fmt.Errorf("no image with id %s in %s", name, c.driver.location())
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if image.Arch != arch {
+			return "", fmt.Errorf("image %s is built for %s, but the commercial type %s runs %s", name, image.Arch, c.driver.CommercialType, arch)
+		}
+
+		return name, nil
+	}
+
+	if id, ok := c.driver.cachedImage(name, arch); ok {
+		return id, nil
+	}
+
+	var id *scw.ScalewayImageIdentifier
+	err := retry("resolve image "+name, true, func() (err error) {
+		id, err = c.api.GetImageID(name, arch)
+		return err
+	})
+	if err == nil {
+		c.driver.cacheImage(id.Identifier, name, arch)
+		return id.Identifier, nil
+	}
+
+	if !strings.HasPrefix(err.Error(), "No such image") {
+		return "", err
+	}
+
+	names, lerr := c.imageNames(arch)
+	if lerr != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no image %s for %s in %s%s", name, arch, c.driver.location(), suggest(name, names))
+}
+
+// imageNames lists the names of the marketplace and organization images which
+// run on arch in the region or zone of the client.
+func (c *client) imageNames(arch string) ([]string, error) {
+	var images *[]scw.MarketImage
+	err := retry("list the images", true, func() (err error) {
+		images, err = c.api.GetImages()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &client{scwAPI, d}, nil
+	var names []string
+	for _, image := range *images {
+		for _, version := range image.Versions {
+			if version.ID != image.CurrentPublicVersion {
+				continue
+			}
+
+			for _, local := range version.LocalImages {
+				if local.Arch == arch && local.Zone == c.driver.location() {
+					names = append(names, image.Name)
+					break
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// resolveSnapshot returns the snapshot with id name, or else the only one named
+// name, checking that it can be restored with the volumes of a server of offer.
+func (c *client) resolveSnapshot(name string, offer *scw.ProductServer, volumes string) (*scw.ScalewaySnapshot, error) {
+	var snapshot *scw.ScalewaySnapshot
+	if anonuuid.IsUUID(name) == nil {
+		err := retry("get snapshot "+name, true, func() (err error) {
+			snapshot, err = c.api.GetSnapshot(name)
+			return err
+		})
+		if isNotFound(err) {
+			return nil, fmt.Errorf("no snapshot with id %s in %s", name, c.driver.location())
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var snapshots *[]scw.ScalewaySnapshot
+		err := retry("list the snapshots", true, func() (err error) {
+			snapshots, err = c.api.GetSnapshots()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var ids, names []string
+		for i, s := range *snapshots {
+			if s.Name == name {
+				snapshot = &(*snapshots)[i]
+				ids = append(ids, s.Identifier)
+			}
+			names = append(names, s.Name)
+		}
+
+		switch len(ids) {
+		case 0:
+			return nil, fmt.Errorf("no snapshot %s in %s%s", name, c.driver.location(), suggest(name, names))
+		case 1:
+		default:
+			sort.Strings(ids)
+			return nil, fmt.Errorf("snapshot name %s is ambiguous, use one of these ids: %s", name, strings.Join(ids, ", "))
+		}
+	}
+
+	if snapshot.State != "available" {
+		return nil, fmt.Errorf("snapshot %s is %s, not available", name, snapshot.State)
+	}
+
+	total := snapshot.Size
+	for _, size := range strings.Fields(volumes) {
+		bytes, err := humanize.ParseBytes(size)
+		if err != nil {
+			return nil, err
+		}
+		total += bytes
+	}
+
+	limits := offer.VolumesConstraint
+	if total < limits.MinSize || (limits.MaxSize > 0 && total > limits.MaxSize) {
+		return nil, fmt.Errorf("snapshot %s holds %s, which with the --scaleway-volumes makes %s, but the commercial type %s takes %s to %s of volumes",
+			name, humanize.Bytes(snapshot.Size), humanize.Bytes(total), c.driver.CommercialType, humanize.Bytes(limits.MinSize), humanize.Bytes(limits.MaxSize))
+	}
+
+	return snapshot, nil
+}
+
+// restoreSnapshot creates a volume named name from snapshot and returns its id.
+func (c *client) restoreSnapshot(snapshot *scw.ScalewaySnapshot, name string) (string, error) {
+	var id string
+	err := retry("restore snapshot "+snapshot.Identifier, false, func() (err error) {
+		id, err = c.api.PostVolumeFromSnapshot(snapshot.Identifier, name, snapshot.VolumeType)
+		return err
+	})
+
+	return id, err
+}
+
+// resolveBootscript returns the id of the bootscript named or identified by
+// name, checking that it boots arch.
+func (c *client) resolveBootscript(name, arch string) (string, error) {
+	if anonuuid.IsUUID(name) == nil {
+		var bootscript *scw.ScalewayBootscript
+		err := retry("get bootscript "+name, true, func() (err error) {
+			bootscript, err = c.api.GetBootscript(name)
+			return err
+		})
+		if isNotFound(err) {
+			return "", fmt.Errorf("no bootscript with id %s in %s", name, c.driver.location())
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if bootscript.Arch != arch {
+			return "", fmt.Errorf("bootscript %s is built for %s, but the commercial type %s runs %s", name, bootscript.Arch, c.driver.CommercialType, arch)
+		}
+
+		return name, nil
+	}
+
+	var id string
+	err := retry("resolve bootscript "+name, true, func() (err error) {
+		id, err = c.api.GetBootscriptID(name, arch)
+		return err
+	})
+	if err == nil {
+		return id, nil
+	}
+
+	if !strings.HasPrefix(err.Error(), "No such bootscript") {
+		return "", err
+	}
+
+	var bootscripts *[]scw.ScalewayBootscript
+	lerr := retry("list the bootscripts", true, func() (err error) {
+		bootscripts, err = c.api.GetBootscripts()
+		return err
+	})
+	if lerr != nil {
+		return "", err
+	}
+
+	// A bootscript of another architecture is a mistake worth naming.
+	var titles []string
+	for _, bootscript := range *bootscripts {
+		if bootscript.Arch == arch {
+			titles = append(titles, bootscript.Title)
+		} else if strings.EqualFold(bootscript.Title, name) {
+			return "", fmt.Errorf("bootscript %s is built for %s, but the commercial type %s runs %s", name, bootscript.Arch, c.driver.CommercialType, arch)
+		}
+	}
+
+	return "", fmt.Errorf("no bootscript %s for %s in %s%s", name, arch, c.driver.location(), suggest(name, titles))
+}
+
+// checkQuotas fails when creating the needed servers, ips and volumes would
+// exceed the organization quotas.
+func (c *client) checkQuotas(needed map[string]int) error {
+	var quotas *scw.ScalewayGetQuotas
+	err := retry("fetch the quotas", true, func() (err error) {
+		quotas, err = c.api.GetQuotas()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fetch the quotas: %v", err)
+	}
+	if len(quotas.Quotas) == 0 {
+		return nil
+	}
+
+	used, err := c.usage()
+	if err != nil {
+		return err
+	}
+
+	var exceeded []string
+	for _, key := range []string{"servers", "ips", "volumes"} {
+		limit, ok := quotas.Quotas[key]
+		if !ok || needed[key] == 0 {
+			continue
+		}
+
+		if used[key]+needed[key] > limit {
+			exceeded = append(exceeded, fmt.Sprintf("%d more %s (%d of %d used)", needed[key], key, used[key], limit))
+		}
+	}
+
+	if len(exceeded) > 0 {
+		return fmt.Errorf("the machine needs %s, which exceeds the quotas of the organization", strings.Join(exceeded, ", "))
+	}
+
+	return nil
+}
+
+// organizationAPI is implemented by the APIs whose quotas cover the
+// organization while GetIPS and GetVolumes list a single region.
+type organizationAPI interface {
+	GetOrganizationIPS() (*scw.ScalewayGetIPS, error)
+	GetOrganizationVolumes() (*[]scw.ScalewayVolume, error)
 }
 
-func (c *client) createServer(config *scw.ConfigCreateServer) (string, error) {
-	return scw.CreateServer(c.api, config)
+// usage counts the servers, IPs and volumes of the organization, in every
+// region.
+func (c *client) usage() (map[string]int, error) {
+	var serverList *[]scw.ScalewayServer
+	err := retry("list the servers", true, func() (err error) {
+		serverList, err = c.api.GetServers(true, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listIPs, listVolumes := c.api.GetIPS, c.api.GetVolumes
+	if api, ok := c.api.(organizationAPI); ok {
+		listIPs, listVolumes = api.GetOrganizationIPS, api.GetOrganizationVolumes
+	}
+
+	var ips *scw.ScalewayGetIPS
+	err = retry("list the IPs", true, func() (err error) {
+		ips, err = listIPs()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes *[]scw.ScalewayVolume
+	err = retry("list the volumes", true, func() (err error) {
+		volumes, err = listVolumes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Regions may be served by the same endpoint, count everything once.
+	servers, ipIDs, volumeIDs := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	for _, s := range *serverList {
+		servers[s.Identifier] = true
+	}
+	for _, ip := range ips.IPS {
+		ipIDs[ip.ID] = true
+	}
+	for _, v := range *volumes {
+		volumeIDs[v.Identifier] = true
+	}
+
+	return map[string]int{
+		"servers": len(servers),
+		"ips":     len(ipIDs),
+		"volumes": len(volumeIDs),
+	}, nil
 }
 
 func (c *client) startServer() error {
-	return c.api.PostServerAction(c.driver.ServerID, "poweron")
+	return c.serverAction("poweron")
 }
 
 func (c *client) rebootServer() error {
-	return c.api.PostServerAction(c.driver.ServerID, "reboot")
+	return c.serverAction("reboot")
 }
 
 func (c *client) stopServer() error {
-	return c.api.PostServerAction(c.driver.ServerID, "poweroff")
+	return c.serverAction("poweroff")
+}
+
+// killServer stops the server without shutting its system down, through the
+// poweroff or stop_in_place action.
+func (c *client) killServer(action string) error {
+	return c.serverAction(action)
+}
+
+// terminateServer stops the server and destroys it along with its volumes.
+func (c *client) terminateServer() error {
+	return c.serverAction("terminate")
+}
+
+// serverAction runs an action on the server. Once processed, an action fails
+// when sent again, so it is only retried when it certainly was not.
+func (c *client) serverAction(action string) error {
+	return retry(action+" the server", false, func() error {
+		return c.api.PostServerAction(c.driver.ServerID, action)
+	})
+}
+
+// findServer returns the server, or nil when it is already gone.
+func (c *client) findServer() (*scw.ScalewayServer, error) {
+	if c.driver.ServerID == "" {
+		return nil, nil
+	}
+
+	server, err := c.getServer()
+	if isNotFound(err) {
+		return nil, nil
+	}
+
+	return server, err
+}
+
+// serverByName returns the server with the given name or id, or nil when there
+// is none.
+func (c *client) serverByName(name string) (*scw.ScalewayServer, error) {
+	var servers *[]scw.ScalewayServer
+	err := retry("list the servers", true, func() (err error) {
+		servers, err = c.api.GetServers(true, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make(map[string]scw.ScalewayServer)
+	for _, s := range *servers {
+		if s.Identifier == name {
+			return &s, nil
+		}
+		if s.Name == name {
+			matches[s.Identifier] = s
+		}
+	}
+
+	if len(matches) > 1 {
+		var ids []string
+		for id := range matches {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return nil, fmt.Errorf("server name %s is ambiguous, use one of these ids: %s", name, strings.Join(ids, ", "))
+	}
+
+	for _, s := range matches {
+		return &s, nil
+	}
+
+	return nil, nil
+}
+
+// hostFingerprints returns the fingerprints of the SSH host keys the server
+// published in its user data, if any.
+func (c *client) hostFingerprints() []string {
+	return c.api.GetSSHFingerprintFromServer(c.driver.ServerID)
+}
+
+// removeServer deletes the server. When stop is set, a server which is not
+// stopped is powered off first, since terminating it would destroy all its
+// volumes.
+func (c *client) removeServer(server *scw.ScalewayServer, stop bool) error {
+	if stop && server.State != "stopped" {
+		log.Infof("Stopping server to keep its volumes...")
+		if err := c.stopServer(); err != nil && !isNotFound(err) {
+			return err
+		}
+
+		if _, err := c.waitForServerState("stopped", c.driver.timeout(c.driver.StopTimeout)); err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	log.Infof("Deleting server...")
+	return c.deleteServer()
+}
+
+// snapshotServer stops the server and snapshots each of its volumes as
+// name-index, then waits for the snapshots to be available. The snapshots are
+// returned by volume index.
+func (c *client) snapshotServer(server *scw.ScalewayServer, name string) (map[string]*scw.ScalewaySnapshot, error) {
+	if server.State != "stopped" {
+		log.Infof("Stopping server to snapshot its volumes...")
+		if err := c.stopServer(); err != nil {
+			return nil, err
+		}
+
+		if _, err := c.waitForServerState("stopped", c.driver.timeout(c.driver.StopTimeout)); err != nil {
+			return nil, err
+		}
+		server.State = "stopped"
+	}
+
+	ids := make(map[string]string)
+	for idx, volume := range server.Volumes {
+		log.Infof("Snapshotting volume %s...", volume.Identifier)
+		var id string
+		err := retry("snapshot volume "+volume.Identifier, false, func() (err error) {
+			id, err = c.api.PostSnapshot(volume.Identifier, name+"-"+idx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		ids[idx] = id
+	}
+
+	snapshots := make(map[string]*scw.ScalewaySnapshot)
+	for idx, id := range ids {
+		snapshot, err := c.waitForSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[idx] = snapshot
+	}
+
+	return snapshots, nil
 }
 
-func (c *client) removeServer() error {
-	if err := c.api.DeleteServerForce(c.driver.ServerID); err != nil {
+// commitServer stops the server, snapshots its root volume and registers an
+// image named name of the snapshot, with the architecture and bootscript of
+// the server. It returns the id of the image.
+func (c *client) commitServer(name string) (string, error) {
+	server, err := c.getServer()
+	if err != nil {
+		return "", err
+	}
+
+	root, ok := server.Volumes["0"]
+	if !ok {
+		return "", fmt.Errorf("server %s has no root volume", server.Identifier)
+	}
+
+	// Only the root volume goes into the image.
+	rootOnly := *server
+	rootOnly.Volumes = map[string]scw.ScalewayVolume{"0": root}
+
+	snapshots, err := c.snapshotServer(&rootOnly, name)
+	if err != nil {
+		return "", err
+	}
+
+	var bootscript string
+	if server.Bootscript != nil {
+		bootscript = server.Bootscript.Identifier
+	}
+
+	log.Infof("Creating image %s...", name)
+	var id string
+	err = retry("create image "+name, false, func() (err error) {
+		id, err = c.api.PostImage(snapshots["0"].Identifier, name, bootscript, server.Arch)
 		return err
+	})
+
+	return id, err
+}
+
+// waitForSnapshot waits for a snapshot to be available and returns it.
+func (c *client) waitForSnapshot(id string) (*scw.ScalewaySnapshot, error) {
+	var snapshot *scw.ScalewaySnapshot
+
+	err := waitFor("snapshot "+id+" to be available", c.driver.timeout(c.driver.RemoveTimeout), func() (bool, error) {
+		err := retry("get snapshot "+id, true, func() (err error) {
+			snapshot, err = c.api.GetSnapshot(id)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if snapshot.State == "error" {
+			return false, fmt.Errorf("snapshot %s failed", id)
+		}
+
+		return snapshot.State == "available", nil
+	})
+
+	return snapshot, err
+}
+
+// removeVolume deletes a volume, after waiting for it to be detached when
+// wait is set.
+func (c *client) removeVolume(id string, wait bool) error {
+	if wait {
+		if err := c.waitForVolumeDetached(id); err != nil {
+			return err
+		}
 	}
 
-	_, err := scw.WaitForServerState(c.api, c.driver.ServerID, "")
+	log.Infof("Deleting volume %s...", id)
+	return c.deleteVolume(id)
+}
+
+// deleteServer deletes or terminates the server and waits for it to be gone.
+// A server which is already gone counts as deleted.
+func (c *client) deleteServer() error {
+	err := retry("delete the server", true, func() error {
+		return c.api.DeleteServerForce(c.driver.ServerID)
+	})
 	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	return c.waitForServerRemoval()
+}
+
+// deleteServerAndVolumes deletes the server, then the volumes which were
+// attached to it.
+func (c *client) deleteServerAndVolumes() error {
+	server, err := c.getServer()
+	if isNotFound(err) {
 		return nil
 	}
 
-	if !c.driver.PersistentIP {
-		if err = c.api.DeleteIP(c.driver.IPID); err != nil {
+	if err != nil {
+		return err
+	}
+
+	if err = c.deleteServer(); err != nil {
+		return err
+	}
+
+	for _, v := range server.Volumes {
+		if err = c.deleteVolume(v.Identifier); err != nil {
 			return err
 		}
 	}
@@ -55,25 +914,509 @@ func (c *client) removeServer() error {
 	return nil
 }
 
+// deleteVolume deletes a volume, ignoring volumes which are already gone.
+func (c *client) deleteVolume(id string) error {
+	err := retry("delete volume "+id, true, func() error {
+		return c.api.DeleteVolume(id)
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// deleteIP releases an IP, ignoring IPs which are already gone.
+func (c *client) deleteIP(id string) error {
+	err := retry("release IP "+id, true, func() error {
+		return c.api.DeleteIP(id)
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// waitForServerState polls the server until it reaches the given state.
+func (c *client) waitForServerState(want string, timeout time.Duration) (*scw.ScalewayServer, error) {
+	var server *scw.ScalewayServer
+
+	err := waitFor("the server to be "+want, timeout, func() (bool, error) {
+		var err error
+		if server, err = c.getServer(); err != nil {
+			return false, err
+		}
+
+		return server.State == want, nil
+	})
+
+	return server, err
+}
+
+// waitForServerRemoval polls the server until the API reports it as missing.
+func (c *client) waitForServerRemoval() error {
+	return waitFor("the server to be removed", c.driver.timeout(c.driver.RemoveTimeout), func() (bool, error) {
+		_, err := c.getServer()
+		if isNotFound(err) {
+			return true, nil
+		}
+
+		return false, err
+	})
+}
+
+// waitForVolumeDetached waits until the volume is no longer attached to a
+// server, or is gone.
+func (c *client) waitForVolumeDetached(id string) error {
+	return waitFor("volume "+id+" to be detached", c.driver.timeout(c.driver.RemoveTimeout), func() (bool, error) {
+		var volume *scw.ScalewayVolume
+		err := retry("get volume "+id, true, func() (err error) {
+			volume, err = c.api.GetVolume(id)
+			return err
+		})
+		if isNotFound(err) {
+			return true, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		return volume.Server == nil || volume.Server.Identifier == "", nil
+	})
+}
+
+// waitForServerReady waits for the server to be running with an address, then
+// for its SSH port to accept connections, from the gateway if there is one.
+// The address is stored in the driver.
 func (c *client) waitForServerReady() error {
-	_, err := scw.WaitForServerReady(c.api, c.driver.ServerID, "")
-	return err
+	var current string
+
+	probe := probeSSH
+	if c.driver.Gateway != "" {
+		g, err := c.driver.openGateway()
+		if err != nil {
+			return err
+		}
+		probe = g.probe
+	}
+
+	return waitFor("the server to be ready", c.driver.timeout(c.driver.CreateTimeout), func() (bool, error) {
+		server, err := c.getServer()
+		if err != nil {
+			return false, err
+		}
+
+		if server.State != current {
+			log.Debugf("Server changed state to '%s'", server.State)
+			current = server.State
+		}
+
+		switch server.State {
+		case "running":
+		case "stopped":
+			return false, errors.New("the server has been stopped")
+		default:
+			return false, nil
+		}
+
+		ip := c.driver.serverAddress(server)
+		if ip == "" {
+			log.Debugf("Waiting for the %s IP of the server", c.driver.addressKind())
+			return false, nil
+		}
+
+		port, err := c.driver.BaseDriver.GetSSHPort()
+		if err != nil {
+			return false, err
+		}
+
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		if err = probe(addr); err != nil {
+			log.Debugf("Waiting for SSH on %s: %v", addr, err)
+			return false, nil
+		}
+
+		c.driver.IPAddress = ip
+		return true, nil
+	})
 }
 
 func (c *client) checkCredentials() error {
-	return c.api.CheckCredentials()
+	return retry("check the credentials", true, c.api.CheckCredentials)
 }
 
-func (c *client) reserveIP() (*scw.ScalewayGetIP, error) {
+func (c *client) reserveIP() (ip *scw.ScalewayGetIP, err error) {
 	if c.driver.IPID != "" {
-		return c.api.GetIP(c.driver.IPID)
+		err = retry("get the reserved IP", true, func() (err error) {
+			ip, err = c.api.GetIP(c.driver.IPID)
+			return err
+		})
+		return ip, err
+	}
+
+	err = retry("reserve an IP", false, func() (err error) {
+		ip, err = c.api.NewIP()
+		return err
+	})
+
+	return ip, err
+}
+
+func (c *client) getServer() (server *scw.ScalewayServer, err error) {
+	err = retry("get the server", true, func() (err error) {
+		server, err = c.api.GetServer(c.driver.ServerID)
+		return err
+	})
+
+	return server, err
+}
+
+func (c *client) getSecurityGroups() (groups *scw.ScalewayGetSecurityGroups, err error) {
+	err = retry("list the security groups", true, func() (err error) {
+		groups, err = c.api.GetSecurityGroups()
+		return err
+	})
+
+	return groups, err
+}
+
+func (c *client) securityGroupID(needle string) (string, error) {
+	groups, err := c.getSecurityGroups()
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+	for _, g := range groups.SecurityGroups {
+		if g.ID == needle {
+			return g.ID, nil
+		}
+		if g.Name == needle {
+			ids = append(ids, g.ID)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no such security group: %s", needle)
+	case 1:
+		return ids[0], nil
+	}
+
+	return "", fmt.Errorf("security group name %s is ambiguous, use one of these ids: %s", needle, strings.Join(ids, ", "))
+}
+
+// groupPort is a port on which a created security group accepts inbound
+// traffic, for the TCP or UDP protocol.
+type groupPort struct {
+	protocol string
+	port     int
+}
+
+// createSecurityGroup creates a security group dropping the inbound traffic
+// but on the given ports and returns its id.
+func (c *client) createSecurityGroup(name string, ports []groupPort) (string, error) {
+	before, err := c.getSecurityGroups()
+	if err != nil {
+		return "", err
+	}
+
+	known := make(map[string]bool)
+	for _, g := range before.SecurityGroups {
+		known[g.ID] = true
+	}
+
+	err = retry("create the security group", false, func() error {
+		return c.api.PostSecurityGroup(scw.ScalewayNewSecurityGroup{
+			Organization: c.driver.Organization,
+			Name:         name,
+			Description:  "Created by docker-machine for " + c.driver.MachineName,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The API does not return the new group, so look it up by name among the
+	// groups that did not exist before.
+	after, err := c.getSecurityGroups()
+	if err != nil {
+		return "", err
 	}
 
-	return c.api.NewIP()
+	var id string
+	for _, g := range after.SecurityGroups {
+		if g.Name == name && !known[g.ID] {
+			id = g.ID
+			break
+		}
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("cannot find the created security group %s", name)
+	}
+
+	for _, p := range ports {
+		rule := scw.ScalewayNewSecurityGroupRule{
+			Action:       "accept",
+			Direction:    "inbound",
+			IPRange:      "0.0.0.0/0",
+			Protocol:     p.protocol,
+			DestPortFrom: p.port,
+		}
+		err = retry("add a security group rule", false, func() error {
+			return c.api.PostSecurityGroupRule(id, rule)
+		})
+		if err != nil {
+			return id, err
+		}
+	}
+
+	return id, nil
+}
+
+func (c *client) setSecurityGroup(id string) error {
+	return retry("set the security group", true, func() error {
+		return c.api.PatchServer(c.driver.ServerID, scw.ScalewayServerPatchDefinition{
+			SecurityGroup: &scw.ScalewaySecurityGroup{Identifier: id},
+		})
+	})
+}
+
+// setLocalBoot makes the server boot from its local volume rather than from a
+// bootscript.
+func (c *client) setLocalBoot() error {
+	api, ok := c.api.(bootTypeAPI)
+	if !ok {
+		return errors.New("the legacy API cannot boot a server from its local volume")
+	}
+
+	return retry("set the boot type", true, func() error {
+		return api.PatchServerBootType(c.driver.ServerID, "local")
+	})
+}
+
+// deleteSecurityGroup deletes a security group, ignoring groups which are
+// already gone.
+func (c *client) deleteSecurityGroup(id string) error {
+	err := retry("delete security group "+id, true, func() error {
+		return c.api.DeleteSecurityGroup(id)
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// setUserdata writes every user data entry on the server and returns the
+// written keys in order.
+func (c *client) setUserdata(data map[string][]byte) ([]string, error) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		err := retry("write user data "+key, true, func() error {
+			return c.api.PatchUserdata(c.driver.ServerID, key, data[key], false)
+		})
+		if err != nil {
+			return keys[:i], fmt.Errorf("cannot write user data %s: %v", key, err)
+		}
+	}
+
+	return keys, nil
+}
+
+// sshKeyAttempts bounds how many times the SSH keys of the account are
+// written when concurrent updates keep undoing the change.
+const sshKeyAttempts = 3
+
+// registerSSHKey adds the public key pub to the SSH keys of the account,
+// unless it is there already, and reports whether the machine owns it: it
+// added it, or another machine of the store which owns it had. A key added
+// by hand stays the user's. The update runs under the SSH key lock of the
+// store. Where the API replaces the keys as a whole, they are read back and
+// updated again when another client overwrote the change.
+func (c *client) registerSSHKey(pub string) (bool, error) {
+	release, err := c.driver.lockSSHKeys()
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if api, ok := c.api.(sshKeyAPI); ok {
+		_, keys, err := c.sshKeys()
+		if err != nil {
+			return false, err
+		}
+
+		if hasSSHKey(keys, pub) {
+			return c.sharedSSHKey(pub), nil
+		}
+
+		err = retry("register the SSH key", false, func() error {
+			return api.PostSSHKey(strings.TrimSpace(pub))
+		})
+		if err != nil {
+			return false, fmt.Errorf("cannot register the SSH key: %v", err)
+		}
+
+		return true, nil
+	}
+
+	for i := 0; i <= sshKeyAttempts; i++ {
+		user, keys, err := c.sshKeys()
+		if err != nil {
+			return false, err
+		}
+
+		if hasSSHKey(keys, pub) {
+			return i > 0 || c.sharedSSHKey(pub), nil
+		}
+
+		if i == sshKeyAttempts {
+			break
+		}
+
+		if i > 0 {
+			log.Debugf("The SSH keys of the account were updated concurrently, adding the key again")
+		}
+
+		keys = append(keys, scw.ScalewayKeyDefinition{Key: strings.TrimSpace(pub)})
+		if err = c.setSSHKeys(user, keys); err != nil {
+			return false, err
+		}
+	}
+
+	return false, errors.New("cannot register the SSH key, concurrent updates of the SSH keys of the account keep dropping it")
+}
+
+// sharedSSHKey tells whether the public key pub, which the account already
+// has, belongs to other machines of the store, and the machine shares it.
+func (c *client) sharedSSHKey(pub string) bool {
+	owners := c.driver.sshKeyOwners(pub)
+	if len(owners) == 0 {
+		log.Debugf("The SSH key is already registered on the account")
+		return false
+	}
+
+	log.Debugf("The SSH key is already registered on the account, by %s", strings.Join(owners, ", "))
+	return true
+}
+
+// deregisterSSHKey removes the public key pub, which the machine owns, from the
+// SSH keys of the account, unless another machine of the store owns it too.
+// Like registerSSHKey, it runs under the SSH key lock and checks the result.
+func (c *client) deregisterSSHKey(pub string) error {
+	release, err := c.driver.lockSSHKeys()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if owners := c.driver.sshKeyOwners(pub); len(owners) > 0 {
+		log.Infof("Keeping the SSH key on the account, %s still uses it", strings.Join(owners, ", "))
+		return nil
+	}
+
+	if api, ok := c.api.(sshKeyAPI); ok {
+		var keys []iamSSHKey
+		err := retry("fetch the SSH keys", true, func() (err error) {
+			keys, err = api.GetSSHKeys()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot fetch the SSH keys of the account: %v", err)
+		}
+
+		for _, k := range keys {
+			if !sameSSHKey(k.PublicKey, pub) {
+				continue
+			}
+
+			id := k.ID
+			err = retry("remove the SSH key "+id, true, func() error {
+				return api.DeleteSSHKey(id)
+			})
+			if err != nil && !isNotFound(err) {
+				return fmt.Errorf("cannot remove the SSH key: %v", err)
+			}
+		}
+
+		return nil
+	}
+
+	for i := 0; i <= sshKeyAttempts; i++ {
+		user, keys, err := c.sshKeys()
+		if err != nil {
+			return err
+		}
+
+		var kept []scw.ScalewayKeyDefinition
+		for _, k := range keys {
+			if !sameSSHKey(k.Key, pub) {
+				kept = append(kept, scw.ScalewayKeyDefinition{Key: k.Key})
+			}
+		}
+
+		if len(kept) == len(keys) {
+			return nil
+		}
+
+		if i == sshKeyAttempts {
+			break
+		}
+
+		if err = c.setSSHKeys(user, kept); err != nil {
+			return err
+		}
+	}
+
+	return errors.New("cannot remove the SSH key, concurrent updates of the SSH keys of the account keep restoring it")
+}
+
+func hasSSHKey(keys []scw.ScalewayKeyDefinition, pub string) bool {
+	for _, k := range keys {
+		if sameSSHKey(k.Key, pub) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sshKeys returns the user the API secret belongs to and its SSH keys.
+func (c *client) sshKeys() (string, []scw.ScalewayKeyDefinition, error) {
+	var user *scw.ScalewayUserDefinition
+	err := retry("fetch the SSH keys", true, func() (err error) {
+		user, err = c.api.GetUser()
+		return err
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot fetch the SSH keys of the account: %v", err)
+	}
+
+	return user.ID, user.SSHPublicKeys, nil
 }
 
-func (c *client) getServer() (*scw.ScalewayServer, error) {
-	return c.api.GetServer(c.driver.ServerID)
+func (c *client) setSSHKeys(user string, keys []scw.ScalewayKeyDefinition) error {
+	if keys == nil {
+		keys = []scw.ScalewayKeyDefinition{}
+	}
+
+	err := retry("update the SSH keys", false, func() error {
+		return c.api.PatchUserSSHKey(user, scw.ScalewayUserPatchSSHKeyDefinition{SSHPublicKeys: keys})
+	})
+	if err != nil {
+		return fmt.Errorf("cannot update the SSH keys of the account: %v", err)
+	}
+
+	return nil
 }
 
 func (c *client) tags() string {
@@ -88,3 +1431,63 @@ func (c *client) tags() string {
 
 	return strings.Join(tagList, " ")
 }
+
+// suggest returns a hint naming the candidates closest to name, for error
+// messages about an unknown name.
+func suggest(name string, candidates []string) string {
+	type match struct {
+		name     string
+		distance int
+	}
+
+	var matches []match
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		d := fuzzy.LevenshteinDistance(strings.ToLower(name), strings.ToLower(c))
+		if fuzzy.MatchFold(name, c) {
+			d = 0
+		}
+
+		if d <= len(name)/3 || d == 1 {
+			matches = append(matches, match{c, d})
+		}
+	}
+
+	if len(matches) == 0 {
+		if len(seen) == 0 || len(seen) > 20 {
+			return ""
+		}
+
+		names := make([]string, 0, len(seen))
+		for c := range seen {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+
+		return ", expecting one of " + strings.Join(names, ", ")
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+
+	var names []string
+	for i := 0; i < len(matches) && i < 3; i++ {
+		names = append(names, matches[i].name)
+	}
+
+	return ", did you mean " + strings.Join(names, " or ") + "?"
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(scw.ScalewayAPIError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,1332 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+const (
+	testImageID          = "a5b1e0a2-8e0e-4b39-9e9f-36a7a9a05f10"
+	testArch             = "x86_64"
+	testDefaultGroupID   = "c7f1b1e8-3f1a-4d0e-9a55-0a1c3b1f6e21"
+	testDefaultGroupName = "Default security group"
+	testAccessKey        = "SCWXXXXXXXXXXXXXXXXX"
+	testProjectID        = "0e4c2f4d-6b1d-4f2e-8d3a-5c7b9e1f2a30"
+	testUserID           = "5a6f3e2b-1c4d-4e8f-9a0b-7c2d1e3f4a5b"
+	testBootscriptID     = "b3c1d2e4-5f6a-4b7c-8d9e-0f1a2b3c4d5e"
+	testBootscript       = "x86_64 mainline 4.14.4 rev1"
+	testArmBootscriptID  = "e4d3c2b1-a0f9-4e8d-9c7b-6a5f4e3d2c1b"
+	testArmBootscript    = "armv7l mainline 4.9.93 rev1"
+)
+
+var uuidSegment = regexp.MustCompile(`[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}`)
+
+// fakeAPI is an in-process stand-in for the account, compute and marketplace
+// APIs, and for the zoned Instance API which serves the same resources. It
+// keeps just enough state to drive a Driver through its whole lifecycle
+// offline, and it can be told to fail chosen requests.
+type fakeAPI struct {
+	mu sync.Mutex
+
+	srv   *httptest.Server
+	dir   string
+	token string
+	seq   int
+
+	servers     map[string]*scw.ScalewayServer
+	ips         map[string]*scw.ScalewayIPDefinition
+	volumes     map[string]*scw.ScalewayVolume
+	images      map[string]*scw.ScalewayImage
+	bootscripts map[string]*scw.ScalewayBootscript
+	snapshots   map[string]*scw.ScalewaySnapshot
+	products    map[string]scw.ProductServer
+	groups      map[string]*scw.ScalewaySecurityGroups
+	rules       map[string][]scw.ScalewaySecurityGroupRule
+	userdata    map[string]map[string][]byte
+	quotas      scw.ScalewayQuota
+
+	// bootTypes holds the boot type the servers were given, by server id.
+	bootTypes map[string]string
+
+	// policies holds the inbound default policy of the created security
+	// groups, by group id.
+	policies map[string]string
+
+	// sshKeys are the SSH keys of the account, or of the project for the
+	// IAM API.
+	sshKeys []iamSSHKey
+
+	// lostSSHKeyUpdates is the number of updates of the account SSH keys to
+	// acknowledge without applying them, as if a concurrent update had
+	// overwritten them.
+	lostSSHKeyUpdates int
+
+	// concurrentSSHKeys are added to the SSH keys of the project, one at a
+	// time, right after the IAM API lists them, as by another client.
+	concurrentSSHKeys []string
+
+	// hostKeys is published as the ssh-host-fingerprints user data of the
+	// servers it creates, like the servers do at boot.
+	hostKeys []byte
+
+	// failures holds the status codes to answer, in order, for a request
+	// key such as "POST /servers/{id}/action".
+	failures map[string][]int
+	calls    []string
+	services map[string]int
+
+	restore []func()
+}
+
+// newFakeAPI starts the fake and points the scaleway-cli API package at it.
+// The returned value must be closed to restore the package defaults.
+func newFakeAPI() *fakeAPI {
+	f := &fakeAPI{
+		token:    testToken,
+		servers:  make(map[string]*scw.ScalewayServer),
+		ips:      make(map[string]*scw.ScalewayIPDefinition),
+		volumes:  make(map[string]*scw.ScalewayVolume),
+		images:   make(map[string]*scw.ScalewayImage),
+		failures: make(map[string][]int),
+		services: make(map[string]int),
+		rules:    make(map[string][]scw.ScalewaySecurityGroupRule),
+		userdata: make(map[string]map[string][]byte),
+		quotas:   make(scw.ScalewayQuota),
+		bootscripts: map[string]*scw.ScalewayBootscript{
+			testBootscriptID:    {Identifier: testBootscriptID, Title: testBootscript, Arch: testArch, Public: true, Default: true},
+			testArmBootscriptID: {Identifier: testArmBootscriptID, Title: testArmBootscript, Arch: "arm", Public: true},
+		},
+		bootTypes: make(map[string]string),
+		policies:  make(map[string]string),
+		snapshots: make(map[string]*scw.ScalewaySnapshot),
+		groups: map[string]*scw.ScalewaySecurityGroups{
+			testDefaultGroupID: {
+				ID:                  testDefaultGroupID,
+				Name:                testDefaultGroupName,
+				Organization:        testOrganization,
+				OrganizationDefault: true,
+			},
+		},
+		products: map[string]scw.ProductServer{
+			"VC1S": {Arch: testArch, Ncpus: 2, AltNames: []string{"X64-2GB"}},
+			"VC1M": {Arch: testArch, Ncpus: 4, AltNames: []string{"X64-4GB"}},
+			"C1":   {Arch: "arm", Ncpus: 4, Baremetal: true},
+		},
+	}
+
+	f.images[testImageID] = &scw.ScalewayImage{
+		Identifier: testImageID,
+		Name:       defaultImage,
+		Arch:       testArch,
+		Public:     true,
+		RootVolume: scw.ScalewayVolume{Size: 50000000000, VolumeType: "l_ssd"},
+	}
+
+	dir, err := ioutil.TempDir("", "scaleway-driver")
+	if err != nil {
+		panic(err)
+	}
+	f.dir = dir
+	f.srv = httptest.NewServer(f)
+
+	f.setenv("HOME", dir)
+	f.setenv("SCW_COMPUTE_API", f.srv.URL+"/compute")
+	f.setvar(&scw.AccountAPI, f.srv.URL+"/account")
+	f.setvar(&scw.MarketplaceAPI, f.srv.URL+"/marketplace")
+	f.setvar(&scw.ComputeAPIPar1, f.srv.URL+"/compute")
+	f.setvar(&scw.ComputeAPIAms1, f.srv.URL+"/compute")
+	f.setvar(&instanceAPIURL, f.srv.URL)
+
+	dial, probe, interval, delay := dialSSH, probeSSH, waitMinInterval, retryMinDelay
+	probeSSH = func(addr string) error { return nil }
+	waitMinInterval = 10 * time.Millisecond
+	retryMinDelay = time.Millisecond
+	f.restore = append(f.restore, func() { dialSSH, probeSSH, waitMinInterval, retryMinDelay = dial, probe, interval, delay })
+
+	return f
+}
+
+func (f *fakeAPI) setenv(key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	f.restore = append(f.restore, func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func (f *fakeAPI) setvar(v *string, value string) {
+	old := *v
+	*v = value
+	f.restore = append(f.restore, func() { *v = old })
+}
+
+func (f *fakeAPI) close() {
+	f.srv.Close()
+	for i := len(f.restore) - 1; i >= 0; i-- {
+		f.restore[i]()
+	}
+	os.RemoveAll(f.dir)
+}
+
+// newDriver returns a driver whose store path lives in the fake's temporary
+// directory and whose credentials are accepted by the fake.
+func (f *fakeAPI) newDriver() *Driver {
+	d := NewDriver(testMachineName, f.dir).(*Driver)
+	d.Organization = testOrganization
+	d.Token = f.token
+
+	if err := os.MkdirAll(d.ResolveStorePath("."), 0700); err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
+// newInstanceDriver returns a driver like newDriver, set up for the Instance
+// API in zone.
+func (f *fakeAPI) newInstanceDriver(zone string) *Driver {
+	d := f.newDriver()
+	d.Organization, d.Token = "", ""
+	d.Zone = zone
+	d.AccessKey = testAccessKey
+	d.SecretKey = f.token
+	d.ProjectID = testProjectID
+
+	return d
+}
+
+// failNext makes the next len(codes) requests matching key answer with the
+// given status codes.
+func (f *fakeAPI) failNext(key string, codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[key] = append(f.failures[key], codes...)
+}
+
+// count returns how many requests matching key were received.
+func (f *fakeAPI) count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, c := range f.calls {
+		if c == key {
+			n++
+		}
+	}
+
+	return n
+}
+
+// served returns how many requests the service, such as "compute" or
+// "instance", received.
+func (f *fakeAPI) served(service string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.services[service]
+}
+
+// resources lists the servers, IPs, volumes and security groups which exist
+// besides the seeded ones, as sorted "kind id" strings.
+func (f *fakeAPI) resources() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res []string
+	for id := range f.servers {
+		res = append(res, "server "+id)
+	}
+	for id := range f.ips {
+		res = append(res, "ip "+id)
+	}
+	for id := range f.volumes {
+		res = append(res, "volume "+id)
+	}
+	for id := range f.groups {
+		if id != testDefaultGroupID {
+			res = append(res, "security group "+id)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func (f *fakeAPI) server(id string) *scw.ScalewayServer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.servers[id]
+}
+
+func (f *fakeAPI) volume(id string) *scw.ScalewayVolume {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.volumes[id]
+}
+
+// dropServer deletes a server behind the driver's back, keeping its volumes.
+func (f *fakeAPI) dropServer(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deleteServer(f.servers[id], false)
+}
+
+func (f *fakeAPI) serverUserdata(id string) map[string][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.userdata[id]
+}
+
+func (f *fakeAPI) setServerState(id, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.servers[id].State = state
+}
+
+func (f *fakeAPI) group(id string) *scw.ScalewaySecurityGroups {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.groups[id]
+}
+
+func (f *fakeAPI) groupRules(id string) []scw.ScalewaySecurityGroupRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rules[id]
+}
+
+func (f *fakeAPI) groupPolicy(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.policies[id]
+}
+
+func (f *fakeAPI) addGroup(name string) *scw.ScalewaySecurityGroups {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	g := &scw.ScalewaySecurityGroups{ID: f.newID(), Name: name, Organization: testOrganization}
+	f.groups[g.ID] = g
+
+	return g
+}
+
+func (f *fakeAPI) addImage(name, arch string, public bool) *scw.ScalewayImage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	img := &scw.ScalewayImage{
+		Identifier: f.newID(),
+		Name:       name,
+		Arch:       arch,
+		Public:     public,
+		RootVolume: scw.ScalewayVolume{Size: 50000000000, VolumeType: "l_ssd"},
+	}
+	f.images[img.Identifier] = img
+
+	return img
+}
+
+func (f *fakeAPI) addSnapshot(name string, size uint64) *scw.ScalewaySnapshot {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	snapshot := &scw.ScalewaySnapshot{
+		Identifier:   f.newID(),
+		Name:         name,
+		Size:         size,
+		Organization: testOrganization,
+		State:        "available",
+		VolumeType:   "l_ssd",
+	}
+	f.snapshots[snapshot.Identifier] = snapshot
+
+	return snapshot
+}
+
+func (f *fakeAPI) setQuota(key string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.quotas[key] = n
+}
+
+func (f *fakeAPI) ip(id string) *scw.ScalewayIPDefinition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ips[id]
+}
+
+func (f *fakeAPI) addIP() *scw.ScalewayIPDefinition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.newIP()
+}
+
+func (f *fakeAPI) newID() string {
+	f.seq++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", f.seq, f.seq)
+}
+
+func (f *fakeAPI) newIP() *scw.ScalewayIPDefinition {
+	ip := &scw.ScalewayIPDefinition{
+		ID:           f.newID(),
+		Organization: testOrganization,
+		Address:      fmt.Sprintf("51.15.0.%d", f.seq),
+	}
+	f.ips[ip.ID] = ip
+
+	return ip
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	service, path := parts[0], "/"
+	if len(parts) == 2 {
+		path += parts[1]
+	}
+	f.services[service]++
+
+	// The Instance API serves the compute resources under a versioned and
+	// zoned prefix, and the new marketplace under a version. Both share the
+	// request keys of the legacy APIs.
+	switch service {
+	case "instance":
+		seg := strings.SplitN(path, "/", 5)
+		if len(seg) < 5 || seg[1] != "v1" || seg[2] != "zones" || !contains(zones, seg[3]) {
+			f.notFound(w)
+			return
+		}
+		path = "/" + seg[4]
+	case "marketplace":
+		path = strings.TrimPrefix(path, "/v1")
+	}
+
+	key := r.Method + " " + uuidSegment.ReplaceAllString(path, "{id}")
+	f.calls = append(f.calls, key)
+
+	if codes := f.failures[key]; len(codes) > 0 {
+		f.failures[key] = codes[1:]
+		f.error(w, codes[0], "fake_error", "injected failure")
+		return
+	}
+
+	if r.Header.Get("X-Auth-Token") != f.token {
+		f.error(w, http.StatusUnauthorized, "invalid_auth", "authentication is denied")
+		return
+	}
+
+	seg := strings.Split(strings.Trim(path, "/"), "/")
+	switch service {
+	case "account":
+		f.serveAccount(w, r, seg)
+	case "compute", "instance":
+		f.serveCompute(w, r, seg)
+	case "iam":
+		f.serveIAM(w, r, seg)
+	case "marketplace":
+		f.serveMarketplace(w, r, seg)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) serveAccount(w http.ResponseWriter, r *http.Request, seg []string) {
+	if r.Method == "GET" && len(seg) == 1 && seg[0] == "tokens" {
+		f.reply(w, http.StatusOK, map[string]interface{}{
+			"tokens": []scw.ScalewayTokenDefinition{{ID: f.token}},
+		})
+		return
+	}
+
+	if r.Method == "GET" && len(seg) == 2 && seg[0] == "tokens" && seg[1] == f.token {
+		f.reply(w, http.StatusOK, scw.ScalewayTokensDefinition{
+			Token: scw.ScalewayTokenDefinition{ID: f.token, UserID: testUserID},
+		})
+		return
+	}
+
+	if len(seg) == 2 && seg[0] == "users" && seg[1] == testUserID {
+		switch r.Method {
+		case "GET":
+			user := scw.ScalewayUserDefinition{ID: testUserID, SSHPublicKeys: []scw.ScalewayKeyDefinition{}}
+			for _, k := range f.sshKeys {
+				user.SSHPublicKeys = append(user.SSHPublicKeys, scw.ScalewayKeyDefinition{Key: k.PublicKey})
+			}
+			f.reply(w, http.StatusOK, scw.ScalewayUsersDefinition{User: user})
+		case "PATCH":
+			var def scw.ScalewayUserPatchSSHKeyDefinition
+			if !f.decode(w, r, &def) {
+				return
+			}
+			if f.lostSSHKeyUpdates > 0 {
+				f.lostSSHKeyUpdates--
+				f.reply(w, http.StatusOK, scw.ScalewayUsersDefinition{})
+				return
+			}
+			f.sshKeys = nil
+			for _, k := range def.SSHPublicKeys {
+				f.sshKeys = append(f.sshKeys, iamSSHKey{ID: f.newID(), PublicKey: k.Key})
+			}
+			f.reply(w, http.StatusOK, scw.ScalewayUsersDefinition{})
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	if r.Method == "GET" && len(seg) == 3 && seg[0] == "organizations" && seg[2] == "quotas" {
+		f.reply(w, http.StatusOK, scw.ScalewayGetQuotas{Quotas: f.quotas})
+		return
+	}
+
+	f.notFound(w)
+}
+
+func (f *fakeAPI) serveIAM(w http.ResponseWriter, r *http.Request, seg []string) {
+	if r.Method == "GET" && len(seg) == 3 && seg[1] == "api-keys" && seg[2] == testAccessKey {
+		f.reply(w, http.StatusOK, map[string]string{"access_key": testAccessKey})
+		return
+	}
+
+	if len(seg) >= 2 && seg[1] == "ssh-keys" {
+		f.serveIAMSSHKeys(w, r, seg[2:])
+		return
+	}
+
+	f.notFound(w)
+}
+
+func (f *fakeAPI) serveIAMSSHKeys(w http.ResponseWriter, r *http.Request, seg []string) {
+	switch {
+	case r.Method == "GET" && len(seg) == 0:
+		keys := []iamSSHKey{}
+		if r.URL.Query().Get("project_id") == testProjectID {
+			keys = append(keys, f.sshKeys...)
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"ssh_keys": keys, "total_count": len(keys)})
+		if len(f.concurrentSSHKeys) > 0 {
+			f.sshKeys = append(f.sshKeys, iamSSHKey{ID: f.newID(), PublicKey: f.concurrentSSHKeys[0], ProjectID: testProjectID})
+			f.concurrentSSHKeys = f.concurrentSSHKeys[1:]
+		}
+	case r.Method == "POST" && len(seg) == 0:
+		var key iamSSHKey
+		if !f.decode(w, r, &key) {
+			return
+		}
+		if key.Name == "" || key.ProjectID != testProjectID {
+			f.error(w, http.StatusBadRequest, "invalid_arguments", "name and project_id are required")
+			return
+		}
+		key.ID = f.newID()
+		f.sshKeys = append(f.sshKeys, key)
+		f.reply(w, http.StatusOK, key)
+	case r.Method == "DELETE" && len(seg) == 1:
+		for i, k := range f.sshKeys {
+			if k.ID == seg[0] {
+				f.sshKeys = append(f.sshKeys[:i], f.sshKeys[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		f.notFound(w)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) serveMarketplace(w http.ResponseWriter, r *http.Request, seg []string) {
+	if r.Method != "GET" || seg[0] != "images" {
+		f.notFound(w)
+		return
+	}
+
+	var images []scw.MarketImage
+	for _, img := range f.images {
+		if !img.Public {
+			continue
+		}
+
+		m := scw.MarketImage{ID: img.Identifier, Name: img.Name, CurrentPublicVersion: img.Identifier}
+		m.Versions = []scw.MarketVersionDefinition{{ID: img.Identifier}}
+		for _, zone := range append([]string{defaultRegion}, zones...) {
+			local := scw.MarketLocalImageDefinition{ID: img.Identifier, Arch: img.Arch, Zone: zone}
+			m.Versions[0].LocalImages = append(m.Versions[0].LocalImages, local)
+		}
+		images = append(images, m)
+	}
+
+	f.reply(w, http.StatusOK, map[string]interface{}{"images": images})
+}
+
+func (f *fakeAPI) serveCompute(w http.ResponseWriter, r *http.Request, seg []string) {
+	switch seg[0] {
+	case "products":
+		f.reply(w, http.StatusOK, scw.ScalewayProductsServers{Servers: f.products})
+	case "images":
+		f.serveImages(w, r, seg[1:])
+	case "bootscripts":
+		f.serveBootscripts(w, r, seg[1:])
+	case "snapshots":
+		f.serveSnapshots(w, r, seg[1:])
+	case "servers":
+		f.serveServers(w, r, seg[1:])
+	case "ips":
+		f.serveIPs(w, r, seg[1:])
+	case "volumes":
+		f.serveVolumes(w, r, seg[1:])
+	case "security_groups":
+		f.serveSecurityGroups(w, r, seg[1:])
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) serveImages(w http.ResponseWriter, r *http.Request, seg []string) {
+	if r.Method == "POST" && len(seg) == 0 {
+		f.createImage(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		f.notFound(w)
+		return
+	}
+
+	if len(seg) == 0 {
+		images := []scw.ScalewayImage{}
+		for _, img := range f.images {
+			if !img.Public {
+				images = append(images, *img)
+			}
+		}
+		f.reply(w, http.StatusOK, scw.ScalewayImages{Images: images})
+		return
+	}
+
+	img, ok := f.images[seg[0]]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	f.reply(w, http.StatusOK, scw.ScalewayOneImage{Image: *img})
+}
+
+// createImage registers an image of a snapshot, which the servers created
+// from it get as their root volume.
+func (f *fakeAPI) createImage(w http.ResponseWriter, r *http.Request) {
+	var def struct {
+		scw.ScalewayImageDefinition
+		Project string `json:"project"`
+	}
+	if !f.decode(w, r, &def) {
+		return
+	}
+
+	s, ok := f.snapshots[def.SnapshotIDentifier]
+	if !ok || s.State != "available" {
+		f.error(w, http.StatusBadRequest, "invalid_request_error", "snapshot is not available")
+		return
+	}
+
+	img := &scw.ScalewayImage{
+		Identifier:   f.newID(),
+		Name:         def.Name,
+		Arch:         def.Arch,
+		Organization: def.Organization,
+		RootVolume:   scw.ScalewayVolume{Identifier: s.Identifier, Size: s.Size, VolumeType: s.VolumeType},
+	}
+	if img.Organization == "" {
+		img.Organization = def.Project
+	}
+
+	if def.DefaultBootscript != nil {
+		b, ok := f.bootscripts[*def.DefaultBootscript]
+		if !ok {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown bootscript")
+			return
+		}
+		img.DefaultBootscript = b
+	}
+
+	f.images[img.Identifier] = img
+	f.reply(w, http.StatusCreated, scw.ScalewayOneImage{Image: *img})
+}
+
+// serveBootscripts names the architecture of the bootscripts both like the
+// legacy API, architecture, and like the Instance API, arch.
+func (f *fakeAPI) serveBootscripts(w http.ResponseWriter, r *http.Request, seg []string) {
+	if r.Method != "GET" {
+		f.notFound(w)
+		return
+	}
+
+	wire := func(b *scw.ScalewayBootscript) map[string]interface{} {
+		return map[string]interface{}{
+			"id":           b.Identifier,
+			"title":        b.Title,
+			"architecture": b.Arch,
+			"arch":         b.Arch,
+			"public":       b.Public,
+			"default":      b.Default,
+		}
+	}
+
+	if len(seg) == 0 {
+		bootscripts := []map[string]interface{}{}
+		for _, b := range f.bootscripts {
+			bootscripts = append(bootscripts, wire(b))
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"bootscripts": bootscripts})
+		return
+	}
+
+	b, ok := f.bootscripts[seg[0]]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	f.reply(w, http.StatusOK, map[string]interface{}{"bootscript": wire(b)})
+}
+
+// serveSnapshots takes the snapshots of a volume in two steps: they are
+// snapshotting when created and available once read.
+func (f *fakeAPI) serveSnapshots(w http.ResponseWriter, r *http.Request, seg []string) {
+	if len(seg) == 0 {
+		switch r.Method {
+		case "GET":
+			snapshots := []scw.ScalewaySnapshot{}
+			for _, s := range f.snapshots {
+				snapshots = append(snapshots, *s)
+			}
+			f.reply(w, http.StatusOK, scw.ScalewaySnapshots{Snapshots: snapshots})
+		case "POST":
+			var def struct {
+				scw.ScalewaySnapshotDefinition
+				Project string `json:"project"`
+			}
+			if !f.decode(w, r, &def) {
+				return
+			}
+			v, ok := f.volumes[def.VolumeIDentifier]
+			if !ok {
+				f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown volume")
+				return
+			}
+			if v.Server != nil && v.Server.Identifier != "" && f.servers[v.Server.Identifier].State != "stopped" {
+				f.error(w, http.StatusBadRequest, "invalid_request_error", "server should be stopped")
+				return
+			}
+			s := &scw.ScalewaySnapshot{
+				Identifier:   f.newID(),
+				Name:         def.Name,
+				Size:         v.Size,
+				Organization: def.Organization,
+				State:        "snapshotting",
+				VolumeType:   v.VolumeType,
+				BaseVolume:   scw.ScalewayVolume{Identifier: v.Identifier, Name: v.Name},
+			}
+			if s.Organization == "" {
+				s.Organization = def.Project
+			}
+			f.snapshots[s.Identifier] = s
+			f.reply(w, http.StatusCreated, scw.ScalewayOneSnapshot{Snapshot: *s})
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	s, ok := f.snapshots[seg[0]]
+	if !ok || r.Method != "GET" {
+		f.notFound(w)
+		return
+	}
+
+	f.reply(w, http.StatusOK, scw.ScalewayOneSnapshot{Snapshot: *s})
+	if s.State == "snapshotting" {
+		s.State = "available"
+	}
+}
+
+func (f *fakeAPI) serveServers(w http.ResponseWriter, r *http.Request, seg []string) {
+	if len(seg) == 0 {
+		switch r.Method {
+		case "GET":
+			servers := []scw.ScalewayServer{}
+			for _, s := range f.servers {
+				servers = append(servers, *s)
+			}
+			f.reply(w, http.StatusOK, scw.ScalewayServers{Servers: servers})
+		case "POST":
+			f.createServer(w, r)
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	s, ok := f.servers[seg[0]]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	if len(seg) == 2 && seg[1] == "action" && r.Method == "POST" {
+		var action scw.ScalewayServerAction
+		if !f.decode(w, r, &action) {
+			return
+		}
+		f.serverAction(w, s, action.Action)
+		return
+	}
+
+	if len(seg) > 1 && seg[1] == "user_data" {
+		f.serveUserdata(w, r, s, seg[2:])
+		return
+	}
+
+	if len(seg) > 1 {
+		f.notFound(w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f.reply(w, http.StatusOK, scw.ScalewayOneServer{Server: *s})
+	case "PATCH":
+		var def struct {
+			scw.ScalewayServerPatchDefinition
+			BootType *string `json:"boot_type"`
+		}
+		if !f.decode(w, r, &def) {
+			return
+		}
+		if def.BootType != nil {
+			f.bootTypes[s.Identifier] = *def.BootType
+		}
+		if def.SecurityGroup != nil {
+			g, ok := f.groups[def.SecurityGroup.Identifier]
+			if !ok {
+				f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown security group")
+				return
+			}
+			s.SecurityGroup = scw.ScalewaySecurityGroup{Identifier: g.ID, Name: g.Name}
+		}
+		f.reply(w, http.StatusOK, scw.ScalewayOneServer{Server: *s})
+	case "DELETE":
+		if s.State != "stopped" {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "server should be stopped")
+			return
+		}
+		f.deleteServer(s, false)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) serveUserdata(w http.ResponseWriter, r *http.Request, s *scw.ScalewayServer, seg []string) {
+	data := f.userdata[s.Identifier]
+
+	if len(seg) == 0 {
+		keys := []string{}
+		for key := range data {
+			keys = append(keys, key)
+		}
+		f.reply(w, http.StatusOK, scw.ScalewayUserdatas{UserData: keys})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		value, ok := data[seg[0]]
+		if !ok {
+			f.notFound(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(value)
+	case "PATCH":
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		if data == nil {
+			data = make(map[string][]byte)
+			f.userdata[s.Identifier] = data
+		}
+		data[seg[0]] = value
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(data, seg[0])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) createServer(w http.ResponseWriter, r *http.Request) {
+	// The legacy API takes volume ids and the Instance API volume objects.
+	var body struct {
+		scw.ScalewayServerDefinition
+		Volumes  map[string]json.RawMessage `json:"volumes"`
+		Project  string                     `json:"project"`
+		BootType string                     `json:"boot_type"`
+	}
+	if !f.decode(w, r, &body) {
+		return
+	}
+
+	def := body.ScalewayServerDefinition
+	if def.Organization == "" {
+		def.Organization = body.Project
+	}
+
+	def.Volumes = make(map[string]string)
+	for idx, raw := range body.Volumes {
+		var volume struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &volume.ID); err != nil {
+			if err = json.Unmarshal(raw, &volume); err != nil {
+				f.error(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+				return
+			}
+		}
+		def.Volumes[idx] = volume.ID
+	}
+
+	offer, ok := f.products[def.CommercialType]
+	if !ok {
+		f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown commercial type")
+		return
+	}
+
+	s := &scw.ScalewayServer{
+		Identifier:     f.newID(),
+		Name:           def.Name,
+		Hostname:       def.Name,
+		Arch:           offer.Arch,
+		State:          "stopped",
+		Organization:   def.Organization,
+		CommercialType: def.CommercialType,
+		Tags:           def.Tags,
+		EnableIPV6:     def.EnableIPV6,
+		Volumes:        make(map[string]scw.ScalewayVolume),
+		SecurityGroup:  scw.ScalewaySecurityGroup{Identifier: testDefaultGroupID, Name: testDefaultGroupName},
+	}
+
+	if def.Image != nil {
+		img, ok := f.images[*def.Image]
+		if !ok {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown image")
+			return
+		}
+		s.Image = *img
+
+		root := &scw.ScalewayVolume{
+			Identifier:   f.newID(),
+			Name:         img.Name,
+			Size:         img.RootVolume.Size,
+			VolumeType:   img.RootVolume.VolumeType,
+			Organization: def.Organization,
+		}
+		f.volumes[root.Identifier] = root
+		def.Volumes["0"] = root.Identifier
+	}
+
+	if def.Bootscript != nil {
+		b, ok := f.bootscripts[*def.Bootscript]
+		if !ok || b.Arch != offer.Arch {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "invalid bootscript")
+			return
+		}
+		s.Bootscript = b
+	}
+
+	for idx, id := range def.Volumes {
+		v, ok := f.volumes[id]
+		if !ok || (v.Server != nil && v.Server.Identifier != "") {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "volume is not available")
+			return
+		}
+		f.attachVolume(s, idx, v)
+	}
+
+	if def.PublicIP != "" {
+		ip, ok := f.ips[def.PublicIP]
+		if !ok {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown ip")
+			return
+		}
+		f.attachIP(s, ip)
+	}
+
+	if f.hostKeys != nil {
+		f.userdata[s.Identifier] = map[string][]byte{"ssh-host-fingerprints": f.hostKeys}
+	}
+
+	if body.BootType != "" {
+		f.bootTypes[s.Identifier] = body.BootType
+	}
+
+	f.servers[s.Identifier] = s
+	f.reply(w, http.StatusCreated, scw.ScalewayOneServer{Server: *s})
+}
+
+func (f *fakeAPI) serverAction(w http.ResponseWriter, s *scw.ScalewayServer, action string) {
+	var want string
+	switch action {
+	case "poweron":
+		want = "stopped"
+		if s.State == "stopped in place" {
+			want = s.State
+		}
+	case "poweroff":
+		want = "running"
+		if s.State == "stopped in place" {
+			want = s.State
+		}
+	case "stop_in_place", "reboot", "terminate":
+		want = "running"
+	default:
+		f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown action")
+		return
+	}
+
+	if s.State != want {
+		f.error(w, http.StatusBadRequest, "invalid_request_error", "server should be "+want)
+		return
+	}
+
+	switch action {
+	case "poweron", "reboot":
+		s.State = "running"
+		s.PrivateIP = fmt.Sprintf("10.1.0.%d", f.seq)
+		f.seq++
+	case "poweroff":
+		s.State = "stopped"
+		s.PrivateIP = ""
+	case "stop_in_place":
+		s.State = "stopped in place"
+	case "terminate":
+		f.deleteServer(s, true)
+	}
+
+	f.reply(w, http.StatusAccepted, scw.ScalewayOneTask{Task: scw.ScalewayTask{Identifier: f.newID()}})
+}
+
+// deleteServer drops a server and detaches its resources. Like the real API,
+// plain deletion keeps the volumes while termination destroys them.
+func (f *fakeAPI) deleteServer(s *scw.ScalewayServer, withVolumes bool) {
+	for _, v := range s.Volumes {
+		if withVolumes {
+			delete(f.volumes, v.Identifier)
+		} else if vol, ok := f.volumes[v.Identifier]; ok {
+			vol.Server = nil
+		}
+	}
+
+	for _, ip := range f.ips {
+		if ip.Server != nil && ip.Server.Identifier == s.Identifier {
+			ip.Server = nil
+		}
+	}
+
+	delete(f.servers, s.Identifier)
+}
+
+func (f *fakeAPI) attachVolume(s *scw.ScalewayServer, idx string, v *scw.ScalewayVolume) {
+	v.Server = &struct {
+		Identifier string `json:"id,omitempty"`
+		Name       string `json:"name,omitempty"`
+	}{s.Identifier, s.Name}
+	s.Volumes[idx] = *v
+}
+
+func (f *fakeAPI) attachIP(s *scw.ScalewayServer, ip *scw.ScalewayIPDefinition) {
+	ip.Server = &struct {
+		Identifier string `json:"id,omitempty"`
+		Name       string `json:"name,omitempty"`
+	}{s.Identifier, s.Name}
+	s.PublicAddress = scw.ScalewayIPAddress{Identifier: ip.ID, IP: ip.Address}
+}
+
+func (f *fakeAPI) serveIPs(w http.ResponseWriter, r *http.Request, seg []string) {
+	if len(seg) == 0 {
+		switch r.Method {
+		case "GET":
+			ips := []scw.ScalewayIPDefinition{}
+			for _, ip := range f.ips {
+				ips = append(ips, *ip)
+			}
+			f.reply(w, http.StatusOK, scw.ScalewayGetIPS{IPS: ips})
+		case "POST":
+			f.reply(w, http.StatusCreated, scw.ScalewayGetIP{IP: *f.newIP()})
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	ip, ok := f.ips[seg[0]]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f.reply(w, http.StatusOK, scw.ScalewayGetIP{IP: *ip})
+	case "PUT":
+		var update struct {
+			Server interface{} `json:"server"`
+		}
+		if !f.decode(w, r, &update) {
+			return
+		}
+		f.detachIP(ip)
+		if id, ok := update.Server.(string); ok && id != "" {
+			s, ok := f.servers[id]
+			if !ok {
+				f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown server")
+				return
+			}
+			f.attachIP(s, ip)
+		}
+		f.reply(w, http.StatusOK, scw.ScalewayGetIP{IP: *ip})
+	case "DELETE":
+		f.detachIP(ip)
+		delete(f.ips, ip.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) detachIP(ip *scw.ScalewayIPDefinition) {
+	if ip.Server == nil {
+		return
+	}
+
+	if s, ok := f.servers[ip.Server.Identifier]; ok {
+		s.PublicAddress = scw.ScalewayIPAddress{}
+	}
+	ip.Server = nil
+}
+
+func (f *fakeAPI) serveVolumes(w http.ResponseWriter, r *http.Request, seg []string) {
+	if len(seg) == 0 {
+		switch r.Method {
+		case "GET":
+			volumes := []scw.ScalewayVolume{}
+			for _, v := range f.volumes {
+				volumes = append(volumes, *v)
+			}
+			f.reply(w, http.StatusOK, scw.ScalewayVolumes{Volumes: volumes})
+		case "POST":
+			// Both APIs restore a snapshot into a new volume.
+			var def struct {
+				scw.ScalewayVolumeDefinition
+				BaseSnapshot string `json:"base_snapshot"`
+			}
+			if !f.decode(w, r, &def) {
+				return
+			}
+			v := &scw.ScalewayVolume{
+				Identifier:   f.newID(),
+				Name:         def.Name,
+				Size:         def.Size,
+				VolumeType:   def.Type,
+				Organization: def.Organization,
+			}
+			if def.BaseSnapshot != "" {
+				s, ok := f.snapshots[def.BaseSnapshot]
+				if !ok {
+					f.error(w, http.StatusBadRequest, "invalid_request_error", "unknown snapshot")
+					return
+				}
+				v.Size = s.Size
+			}
+			f.volumes[v.Identifier] = v
+			f.reply(w, http.StatusCreated, scw.ScalewayOneVolume{Volume: *v})
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	v, ok := f.volumes[seg[0]]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f.reply(w, http.StatusOK, scw.ScalewayOneVolume{Volume: *v})
+	case "PUT":
+		var def scw.ScalewayVolumePutDefinition
+		if !f.decode(w, r, &def) {
+			return
+		}
+		if def.Name != nil {
+			v.Name = *def.Name
+		}
+		f.reply(w, http.StatusOK, scw.ScalewayOneVolume{Volume: *v})
+	case "DELETE":
+		if v.Server != nil && v.Server.Identifier != "" {
+			f.error(w, http.StatusBadRequest, "invalid_request_error", "volume is attached to a server")
+			return
+		}
+		delete(f.volumes, v.Identifier)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) serveSecurityGroups(w http.ResponseWriter, r *http.Request, seg []string) {
+	if len(seg) == 0 {
+		switch r.Method {
+		case "GET":
+			groups := []scw.ScalewaySecurityGroups{}
+			for _, g := range f.groups {
+				groups = append(groups, *g)
+			}
+			f.reply(w, http.StatusOK, scw.ScalewayGetSecurityGroups{SecurityGroups: groups})
+		case "POST":
+			var def struct {
+				scw.ScalewayNewSecurityGroup
+				InboundDefaultPolicy string `json:"inbound_default_policy"`
+			}
+			if !f.decode(w, r, &def) {
+				return
+			}
+			g := &scw.ScalewaySecurityGroups{
+				ID:           f.newID(),
+				Name:         def.Name,
+				Description:  def.Description,
+				Organization: def.Organization,
+			}
+			f.groups[g.ID] = g
+			f.policies[g.ID] = def.InboundDefaultPolicy
+			f.reply(w, http.StatusCreated, scw.ScalewayGetSecurityGroup{SecurityGroups: *g})
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	g, ok := f.groups[seg[0]]
+	if !ok {
+		f.notFound(w)
+		return
+	}
+
+	if len(seg) == 2 && seg[1] == "rules" {
+		switch r.Method {
+		case "GET":
+			f.reply(w, http.StatusOK, scw.ScalewayGetSecurityGroupRules{Rules: f.rules[g.ID]})
+		case "POST":
+			var def scw.ScalewayNewSecurityGroupRule
+			if !f.decode(w, r, &def) {
+				return
+			}
+			rule := scw.ScalewaySecurityGroupRule{
+				ID:           f.newID(),
+				Action:       def.Action,
+				Direction:    def.Direction,
+				IPRange:      def.IPRange,
+				Protocol:     def.Protocol,
+				DestPortFrom: def.DestPortFrom,
+				Position:     len(f.rules[g.ID]) + 1,
+				Editable:     true,
+			}
+			f.rules[g.ID] = append(f.rules[g.ID], rule)
+			f.reply(w, http.StatusCreated, scw.ScalewayGetSecurityGroupRule{Rules: rule})
+		default:
+			f.notFound(w)
+		}
+		return
+	}
+
+	if len(seg) > 1 {
+		f.notFound(w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f.reply(w, http.StatusOK, scw.ScalewayGetSecurityGroup{SecurityGroups: *g})
+	case "DELETE":
+		for _, s := range f.servers {
+			if s.SecurityGroup.Identifier == g.ID {
+				f.error(w, http.StatusBadRequest, "invalid_request_error", "group is in use by servers")
+				return
+			}
+		}
+		delete(f.groups, g.ID)
+		delete(f.rules, g.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.notFound(w)
+	}
+}
+
+func (f *fakeAPI) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		f.error(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (f *fakeAPI) reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeAPI) error(w http.ResponseWriter, code int, kind, message string) {
+	f.reply(w, code, scw.ScalewayAPIError{Type: kind, APIMessage: message})
+}
+
+func (f *fakeAPI) notFound(w http.ResponseWriter) {
+	f.error(w, http.StatusNotFound, "unknown_resource", "resource not found")
+}
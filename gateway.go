@@ -0,0 +1,262 @@
+package scaleway
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/scaleway/scaleway-cli/pkg/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// gatewayUser is the user of the gateway unless --scaleway-gateway names one.
+const gatewayUser = "root"
+
+// gateway is an SSH connection to the jump host of --scaleway-gateway, through
+// which the driver reaches servers it cannot connect to directly.
+type gateway struct {
+	client *ssh.Client
+
+	mu     sync.Mutex
+	tunnel net.Listener
+	target string
+}
+
+// parseGateway splits a [user@]host[:port] gateway.
+func parseGateway(spec string) (user, host, port string) {
+	user, host, port = gatewayUser, spec, "22"
+
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+	}
+
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+
+	return user, host, port
+}
+
+// resolveGateway sets the address of the gateway. A host which is neither an
+// IP address nor a domain name is looked up among the servers of the account
+// first.
+func (d *Driver) resolveGateway(c machineClient) error {
+	if d.Gateway == "" || d.GatewayAddress != "" {
+		return nil
+	}
+
+	_, host, port := parseGateway(d.Gateway)
+	if net.ParseIP(host) == nil && !strings.Contains(host, ".") {
+		server, err := c.serverByName(host)
+		if err != nil {
+			return err
+		}
+
+		if server != nil {
+			if server.PublicAddress.IP == "" {
+				return fmt.Errorf("the gateway server %s has no public IP address", host)
+			}
+			host = server.PublicAddress.IP
+		}
+	}
+
+	d.GatewayAddress = net.JoinHostPort(host, port)
+	return nil
+}
+
+// openGateway connects to the gateway, once per driver process.
+func (d *Driver) openGateway() (*gateway, error) {
+	if d.gateway != nil {
+		return d.gateway, nil
+	}
+
+	if d.GatewayAddress == "" {
+		c, err := d.client()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = d.resolveGateway(c); err != nil {
+			return nil, err
+		}
+	}
+
+	hostKey, err := gatewayHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	user, _, _ := parseGateway(d.Gateway)
+	client, err := ssh.Dial("tcp", d.GatewayAddress, &ssh.ClientConfig{
+		User:            user,
+		Auth:            d.gatewayAuth(),
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the gateway %s: %v", d.Gateway, err)
+	}
+
+	d.gateway = &gateway{client: client}
+	return d.gateway, nil
+}
+
+// gatewayAuth offers the keys of the SSH agent, the default keys of the user
+// and the key of the machine.
+func (d *Driver) gatewayAuth() []ssh.AuthMethod {
+	var auth []ssh.AuthMethod
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Debugf("Cannot use the SSH agent: %v", err)
+		}
+	}
+
+	paths := []string{d.GetSSHKeyPath()}
+	if home, err := config.GetHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_rsa"))
+	}
+
+	var signers []ssh.Signer
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			log.Debugf("Cannot use the SSH key %s for the gateway: %v", path, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	return auth
+}
+
+// gatewayHostKey checks the host key of the gateway against the known hosts of
+// the user, if any.
+func gatewayHostKey() (ssh.HostKeyCallback, error) {
+	home, err := config.GetHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		log.Warnf("No %s, the host key of the gateway cannot be verified", path)
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	return knownhosts.New(path)
+}
+
+// dial connects to addr from the gateway.
+func (g *gateway) dial(addr string) (net.Conn, error) {
+	return g.client.Dial("tcp", addr)
+}
+
+// probe checks that addr accepts connections from the gateway.
+func (g *gateway) probe(addr string) error {
+	conn, err := g.dial(addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// forward forwards the connections to a local port to addr, through the
+// gateway, and returns the local address. The tunnel lives as long as the
+// driver process; forwarding again only changes its target.
+func (g *gateway) forward(addr string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.target = addr
+	if g.tunnel != nil {
+		return g.tunnel.Addr().String(), nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	g.tunnel = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go g.pipe(conn)
+		}
+	}()
+
+	return l.Addr().String(), nil
+}
+
+func (g *gateway) pipe(local net.Conn) {
+	defer local.Close()
+
+	g.mu.Lock()
+	target := g.target
+	g.mu.Unlock()
+
+	remote, err := g.client.Dial("tcp", target)
+	if err != nil {
+		log.Debugf("Cannot reach %s through the gateway: %v", target, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// sshTunnel returns the local address of the tunnel to the SSH port of the
+// server through the gateway.
+func (d *Driver) sshTunnel() (string, error) {
+	ip, err := d.GetIP()
+	if err != nil {
+		return "", err
+	}
+
+	port, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return "", err
+	}
+
+	g, err := d.openGateway()
+	if err != nil {
+		return "", err
+	}
+
+	return g.forward(net.JoinHostPort(ip, strconv.Itoa(port)))
+}
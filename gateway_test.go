@@ -0,0 +1,263 @@
+package scaleway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeGateway is an SSH server which forwards every direct-tcpip channel to
+// a local echo server, or to forward when set, and records the requested
+// targets.
+type fakeGateway struct {
+	listener net.Listener
+	echo     net.Listener
+	hostKey  ssh.PublicKey
+	forward  string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	g := &fakeGateway{hostKey: signer.PublicKey()}
+	if g.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if g.echo, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := g.echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := g.listener.Accept()
+			if err != nil {
+				return
+			}
+			go g.serve(conn, config)
+		}
+	}()
+
+	return g
+}
+
+func (g *fakeGateway) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for nc := range channels {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &target) != nil {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+
+		g.mu.Lock()
+		g.targets = append(g.targets, net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		forward := g.forward
+		g.mu.Unlock()
+
+		if forward == "" {
+			forward = g.echo.Addr().String()
+		}
+
+		remote, err := net.Dial("tcp", forward)
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			defer ch.Close()
+			defer remote.Close()
+			go io.Copy(remote, ch)
+			io.Copy(ch, remote)
+		}()
+	}
+}
+
+func (g *fakeGateway) lastTarget() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.targets) == 0 {
+		return ""
+	}
+	return g.targets[len(g.targets)-1]
+}
+
+func (g *fakeGateway) close() {
+	g.listener.Close()
+	g.echo.Close()
+}
+
+func TestParseGateway(t *testing.T) {
+	for _, tc := range []struct {
+		spec, user, host, port string
+	}{
+		{"bastion", gatewayUser, "bastion", "22"},
+		{"admin@bastion", "admin", "bastion", "22"},
+		{"admin@10.1.2.3:2222", "admin", "10.1.2.3", "2222"},
+		{"[2001:db8::1]:2222", gatewayUser, "2001:db8::1", "2222"},
+		{"jump.example.com", gatewayUser, "jump.example.com", "22"},
+	} {
+		user, host, port := parseGateway(tc.spec)
+		if user != tc.user || host != tc.host || port != tc.port {
+			t.Errorf("%s: expecting '%s' '%s' '%s', got '%s' '%s' '%s'\n", tc.spec, tc.user, tc.host, tc.port, user, host, port)
+		}
+	}
+}
+
+func TestCreateThroughGateway(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+	f.setenv("SSH_AUTH_SOCK", "")
+
+	g := newFakeGateway(t)
+	defer g.close()
+
+	probeSSH = func(addr string) error {
+		t.Errorf("Expecting %s to be probed through the gateway\n", addr)
+		return nil
+	}
+
+	td := f.newDriver()
+	td.Gateway = "root@" + g.listener.Addr().String()
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := td.IPAddress + ":22"
+	if target := g.lastTarget(); target != expected {
+		t.Errorf("Expecting SSH to be probed on '%s', got '%s'\n", expected, target)
+	}
+
+	loaded := reload(t, td)
+	host, err := loaded.GetSSHHostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := loaded.GetSSHPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if host != "127.0.0.1" || port == 22 {
+		t.Errorf("Expecting a local tunnel, got '%s:%d'\n", host, port)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 14)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+		t.Errorf("Expecting the tunnel to reach the server, got '%s' (%v)\n", buf, err)
+	}
+
+	if target := g.lastTarget(); target != expected {
+		t.Errorf("Expecting the tunnel to lead to '%s', got '%s'\n", expected, target)
+	}
+
+	if err := loaded.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveGateway(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	bastion := NewDriver("bastion", f.dir).(*Driver)
+	bastion.Organization, bastion.Token = testOrganization, f.token
+	bastion.ServerName = "bastion"
+	if err := os.MkdirAll(bastion.ResolveStorePath("."), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bastion.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		gateway, address string
+	}{
+		{"bastion", bastion.IPAddress + ":22"},
+		{"admin@bastion:2222", bastion.IPAddress + ":2222"},
+		{bastion.ServerID, bastion.IPAddress + ":22"},
+		{"jump", "jump:22"},
+		{"jump.example.com", "jump.example.com:22"},
+	} {
+		td := f.newDriver()
+		td.Gateway = tc.gateway
+
+		c, err := td.client()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = td.resolveGateway(c); err != nil {
+			t.Fatal(err)
+		}
+
+		if td.GatewayAddress != tc.address {
+			t.Errorf("%s: expecting '%s', got '%s'\n", tc.gateway, tc.address, td.GatewayAddress)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package scaleway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// errHostKeyRead stops the SSH handshake once the host key is known.
+var errHostKeyRead = errors.New("host key read")
+
+// fingerprintsTimeout bounds the wait for the server to publish its host key
+// fingerprints in strict mode: most images publish them within seconds of
+// sshd starting, and the others never do.
+var fingerprintsTimeout = time.Minute
+
+// verifyHostKey checks the host key the server presents over SSH against the
+// fingerprints the server published in its user data, which are stored in the
+// driver. A mismatch, or fingerprints still missing after fingerprintsTimeout,
+// fail when --scaleway-host-key-check is strict.
+//
+// The check only covers the connection it opens: the SSH client docker-machine
+// provisions the server with does not verify host keys, and the driver has no
+// way to pin the key there.
+func (d *Driver) verifyHostKey(c machineClient) error {
+	// The server publishes them once booted, possibly after sshd is up.
+	published := c.hostFingerprints()
+	if len(published) == 0 && d.HostKeyCheck != "warn" {
+		timeout := fingerprintsTimeout
+		if create := d.timeout(d.CreateTimeout); create > 0 && create < timeout {
+			timeout = create
+		}
+
+		err := waitFor("the SSH host key fingerprints", timeout, func() (bool, error) {
+			published = c.hostFingerprints()
+			return len(published) > 0, nil
+		})
+		if err != nil {
+			return fmt.Errorf("the server published no SSH host key fingerprints, its host key cannot be verified: %v", err)
+		}
+	}
+
+	d.SSHHostFingerprints = nil
+	for _, fp := range published {
+		// Drop the comment, the host name of the server.
+		if fields := strings.Fields(fp); len(fields) >= 2 {
+			d.SSHHostFingerprints = append(d.SSHHostFingerprints, fields[0]+" "+fields[1])
+		}
+	}
+
+	if len(d.SSHHostFingerprints) == 0 {
+		if d.HostKeyCheck != "warn" {
+			return errors.New("the server published no valid SSH host key fingerprints, its host key cannot be verified")
+		}
+		log.Warnf("The server published no SSH host key fingerprints, its host key cannot be verified")
+		return nil
+	}
+
+	port, err := d.BaseDriver.GetSSHPort()
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(d.IPAddress, strconv.Itoa(port))
+
+	dial := dialSSH
+	if d.Gateway != "" {
+		g, err := d.openGateway()
+		if err != nil {
+			return err
+		}
+		dial = g.dial
+	}
+
+	conn, err := dial(addr)
+	if err != nil {
+		return fmt.Errorf("cannot read the SSH host key of the server: %v", err)
+	}
+
+	key, err := readHostKey(conn, addr, d.hostKeyAlgorithms())
+	if err != nil {
+		return fmt.Errorf("cannot read the SSH host key of the server: %v", err)
+	}
+
+	actual := fingerprint(key)
+	for _, expected := range d.SSHHostFingerprints {
+		if actual == expected {
+			log.Debugf("The SSH host key of the server matches %s", actual)
+			return nil
+		}
+	}
+
+	err = fmt.Errorf("the SSH host key of the server, %s, does not match the published ones: %s",
+		actual, strings.Join(d.SSHHostFingerprints, ", "))
+	if d.HostKeyCheck == "warn" {
+		log.Warnf("%v", err)
+		return nil
+	}
+
+	return err
+}
+
+// hostKeyAlgorithms lists the key types of the published fingerprints, so that
+// the server presents one of these keys.
+func (d *Driver) hostKeyAlgorithms() []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, fp := range d.SSHHostFingerprints {
+		algorithm := strings.Fields(fp)[0]
+		if !seen[algorithm] {
+			seen[algorithm] = true
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+
+	return algorithms
+}
+
+// readHostKey runs the beginning of an SSH handshake on conn, until the server
+// presents its host key, and closes conn.
+func readHostKey(conn net.Conn, addr string, algorithms []string) (ssh.PublicKey, error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var key ssh.PublicKey
+	_, _, _, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errHostKeyRead
+		},
+	})
+
+	if key == nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// fingerprint formats key like the fingerprints servers publish: its type and
+// its MD5 fingerprint.
+func fingerprint(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintLegacyMD5(key)
+}
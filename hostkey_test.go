@@ -0,0 +1,99 @@
+package scaleway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVerifyHostKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Strict mode gives up on missing fingerprints long before the creation
+	// timeout.
+	defer func(timeout time.Duration) { fingerprintsTimeout = timeout }(fingerprintsTimeout)
+	fingerprintsTimeout = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name      string
+		published []string
+		check     string
+		gateway   bool
+		late      bool
+		valid     bool
+		stored    bool
+	}{
+		{"match", []string{"server"}, "strict", false, false, true, true},
+		{"match through the gateway", []string{"server"}, "strict", true, false, true, true},
+		{"mismatch", []string{"other"}, "strict", false, false, false, true},
+		{"mismatch warning", []string{"other"}, "warn", false, false, true, true},
+		{"both keys", []string{"other", "server"}, "strict", false, false, true, true},
+		{"published late", []string{"server"}, "strict", false, true, true, true},
+		{"none published", nil, "strict", false, false, false, false},
+		{"none published warning", nil, "warn", false, false, true, false},
+	} {
+		f := newFakeAPI()
+		f.setenv("SSH_AUTH_SOCK", "")
+
+		// The gateway doubles as the SSH server of the machine.
+		g := newFakeGateway(t)
+		g.forward = g.listener.Addr().String()
+		dialSSH = func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", g.listener.Addr().String())
+		}
+
+		keys := map[string]ssh.PublicKey{"server": g.hostKey, "other": other}
+		for _, name := range tc.published {
+			f.hostKeys = append(f.hostKeys, ssh.MarshalAuthorizedKey(keys[name])...)
+		}
+
+		if tc.late {
+			f.failNext("GET /servers/{id}/user_data/ssh-host-fingerprints", http.StatusNotFound, http.StatusNotFound)
+		}
+
+		td := f.newDriver()
+		td.HostKeyCheck = tc.check
+		if tc.gateway {
+			td.Gateway = g.listener.Addr().String()
+			dialSSH = func(addr string) (net.Conn, error) {
+				return nil, errors.New("expecting the gateway to be used")
+			}
+		}
+
+		start := time.Now()
+		err := td.Create()
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: expecting the check to give up quickly, took %v\n", tc.name, elapsed)
+		}
+
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expecting valid: %v, got '%v'\n", tc.name, tc.valid, err)
+		}
+
+		if stored := len(td.SSHHostFingerprints) > 0; stored != tc.stored {
+			t.Errorf("%s: expecting the fingerprints to be stored: %v, got %v\n", tc.name, tc.stored, td.SSHHostFingerprints)
+		}
+
+		if !tc.valid && len(f.resources()) != 0 {
+			t.Errorf("%s: expecting the server to be removed, got %v\n", tc.name, f.resources())
+		}
+
+		g.close()
+		f.close()
+	}
+}
@@ -0,0 +1,603 @@
+package scaleway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+	"github.com/scaleway/scaleway-cli/pkg/utils"
+)
+
+// instanceAPIURL is the endpoint of the zoned Instance API, which SCW_API_URL
+// overrides.
+var instanceAPIURL = "https://api.scaleway.com"
+
+const instancePerPage = 100
+
+// instanceAPI speaks the zoned Instance API, authenticated with an IAM API key
+// and scoped to a project. It exposes the subset of the methods of
+// scw.ScalewayAPI that the client needs, with the same types.
+type instanceAPI struct {
+	url       string
+	zone      string
+	accessKey string
+	secretKey string
+	projectID string
+	http      *http.Client
+}
+
+func newInstanceAPI(zone, accessKey, secretKey, projectID string) *instanceAPI {
+	api := &instanceAPI{
+		url:       instanceAPIURL,
+		zone:      zone,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		projectID: projectID,
+		http:      newHTTPClient(),
+	}
+
+	if u := os.Getenv("SCW_API_URL"); u != "" {
+		api.url = u
+	}
+	api.url = strings.TrimRight(api.url, "/")
+
+	return api
+}
+
+// do sends a request to path of the API.
+func (a *instanceAPI) do(method, path string, query url.Values, body, out interface{}, expected int) error {
+	return send(a.http, a.secretKey, method, a.url+path, query, body, out, expected)
+}
+
+func (a *instanceAPI) zoned(resource string) string {
+	return "/instance/v1/zones/" + a.zone + "/" + resource
+}
+
+// list fetches every page of a zoned collection of the project. fetch decodes
+// a page and returns how many items it held.
+func (a *instanceAPI) list(resource string, fetch func(query url.Values) (int, error)) error {
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("project", a.projectID)
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(instancePerPage))
+
+		n, err := fetch(query)
+		if err != nil || n < instancePerPage {
+			return err
+		}
+	}
+}
+
+// CheckCredentials fetches the API key, which fails unless the secret key
+// belongs to it.
+func (a *instanceAPI) CheckCredentials() error {
+	return a.do("GET", "/iam/v1alpha1/api-keys/"+a.accessKey, nil, nil, nil, http.StatusOK)
+}
+
+// iamSSHKey is an SSH key of a project in the IAM API.
+type iamSSHKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"public_key"`
+	ProjectID string `json:"project_id,omitempty"`
+}
+
+// GetSSHKeys returns the SSH keys of the project.
+func (a *instanceAPI) GetSSHKeys() ([]iamSSHKey, error) {
+	var keys []iamSSHKey
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("project_id", a.projectID)
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(instancePerPage))
+
+		var resp struct {
+			SSHKeys []iamSSHKey `json:"ssh_keys"`
+		}
+		if err := a.do("GET", "/iam/v1alpha1/ssh-keys", query, nil, &resp, http.StatusOK); err != nil {
+			return nil, err
+		}
+		keys = append(keys, resp.SSHKeys...)
+
+		if len(resp.SSHKeys) < instancePerPage {
+			return keys, nil
+		}
+	}
+}
+
+// GetUser returns the SSH keys of the project, as those of a user with the
+// project id: the IAM API attaches SSH keys to projects.
+func (a *instanceAPI) GetUser() (*scw.ScalewayUserDefinition, error) {
+	keys, err := a.GetSSHKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &scw.ScalewayUserDefinition{ID: a.projectID, SSHPublicKeys: []scw.ScalewayKeyDefinition{}}
+	for _, k := range keys {
+		user.SSHPublicKeys = append(user.SSHPublicKeys, scw.ScalewayKeyDefinition{Key: k.PublicKey})
+	}
+
+	return user, nil
+}
+
+// PatchUserSSHKey is not supported: replacing the keys of the project as a
+// whole would delete the keys added concurrently. The client creates and
+// deletes them one at a time instead.
+func (a *instanceAPI) PatchUserSSHKey(userID string, definition scw.ScalewayUserPatchSSHKeyDefinition) error {
+	return errors.New("the Instance API cannot replace the SSH keys of the project")
+}
+
+// PostSSHKey adds the public key pub to the SSH keys of the project.
+func (a *instanceAPI) PostSSHKey(pub string) error {
+	key := iamSSHKey{Name: "docker-machine", PublicKey: pub, ProjectID: a.projectID}
+
+	return a.do("POST", "/iam/v1alpha1/ssh-keys", nil, key, nil, http.StatusOK)
+}
+
+// DeleteSSHKey deletes the SSH key keyID of the project.
+func (a *instanceAPI) DeleteSSHKey(keyID string) error {
+	return a.do("DELETE", "/iam/v1alpha1/ssh-keys/"+keyID, nil, nil, nil, http.StatusNoContent)
+}
+
+// GetQuotas returns no quota: the Instance API does not expose them.
+func (a *instanceAPI) GetQuotas() (*scw.ScalewayGetQuotas, error) {
+	return &scw.ScalewayGetQuotas{Quotas: scw.ScalewayQuota{}}, nil
+}
+
+func (a *instanceAPI) GetProductsServers() (*scw.ScalewayProductsServers, error) {
+	var products scw.ScalewayProductsServers
+	query := url.Values{"per_page": {strconv.Itoa(instancePerPage)}}
+	err := a.do("GET", a.zoned("products/servers"), query, nil, &products, http.StatusOK)
+
+	return &products, err
+}
+
+func (a *instanceAPI) GetImage(imageID string) (*scw.ScalewayImage, error) {
+	var one scw.ScalewayOneImage
+	err := a.do("GET", a.zoned("images/"+imageID), nil, nil, &one, http.StatusOK)
+
+	return &one.Image, err
+}
+
+// PostImage creates an image of the snapshot volumeID, like its
+// scw.ScalewayAPI counterpart.
+func (a *instanceAPI) PostImage(volumeID, name, bootscript, arch string) (string, error) {
+	body := map[string]interface{}{
+		"name":        name,
+		"root_volume": volumeID,
+		"arch":        arch,
+		"project":     a.projectID,
+	}
+	if bootscript != "" {
+		body["default_bootscript"] = bootscript
+	}
+
+	var one scw.ScalewayOneImage
+	err := a.do("POST", a.zoned("images"), nil, body, &one, http.StatusCreated)
+
+	return one.Image.Identifier, err
+}
+
+// GetImages lists the marketplace images and the images of the project, in the
+// shape of the legacy marketplace.
+func (a *instanceAPI) GetImages() (*[]scw.MarketImage, error) {
+	var market struct {
+		Images []scw.MarketImage `json:"images"`
+	}
+	query := url.Values{"per_page": {strconv.Itoa(instancePerPage)}}
+	if err := a.do("GET", "/marketplace/v1/images", query, nil, &market, http.StatusOK); err != nil {
+		return nil, err
+	}
+	images := market.Images
+
+	err := a.list("images", func(query url.Values) (int, error) {
+		var page scw.ScalewayImages
+		if err := a.do("GET", a.zoned("images"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+
+		for _, img := range page.Images {
+			m := scw.MarketImage{Name: img.Name, CurrentPublicVersion: img.Identifier}
+			m.Versions = []scw.MarketVersionDefinition{{ID: img.Identifier}}
+			m.Versions[0].LocalImages = []scw.MarketLocalImageDefinition{
+				{ID: img.Identifier, Arch: img.Arch, Zone: a.zone},
+			}
+			images = append(images, m)
+		}
+
+		return len(page.Images), nil
+	})
+
+	return &images, err
+}
+
+// GetImageID returns the only image named needle which runs on arch in the
+// zone, among the marketplace and project images.
+func (a *instanceAPI) GetImageID(needle, arch string) (*scw.ScalewayImageIdentifier, error) {
+	images, err := a.GetImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for _, image := range *images {
+		if !strings.EqualFold(image.Name, needle) {
+			continue
+		}
+
+		for _, version := range image.Versions {
+			if version.ID != image.CurrentPublicVersion {
+				continue
+			}
+
+			for _, local := range version.LocalImages {
+				if local.Arch == arch && local.Zone == a.zone {
+					found = append(found, local.ID)
+				}
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No such image (zone %s, arch %s) : %s", a.zone, arch, needle)
+	case 1:
+		return &scw.ScalewayImageIdentifier{Identifier: found[0], Arch: arch, Region: a.zone}, nil
+	}
+
+	return nil, fmt.Errorf("image %s is ambiguous, use one of these ids: %s", needle, strings.Join(found, ", "))
+}
+
+// instanceBootscript is a bootscript of the Instance API, which names the
+// architecture arch.
+type instanceBootscript struct {
+	scw.ScalewayBootscript
+	Arch string `json:"arch"`
+}
+
+func (b instanceBootscript) bootscript() scw.ScalewayBootscript {
+	bootscript := b.ScalewayBootscript
+	bootscript.Arch = b.Arch
+	return bootscript
+}
+
+func (a *instanceAPI) GetBootscript(bootscriptID string) (*scw.ScalewayBootscript, error) {
+	var one struct {
+		Bootscript instanceBootscript `json:"bootscript"`
+	}
+	if err := a.do("GET", a.zoned("bootscripts/"+bootscriptID), nil, nil, &one, http.StatusOK); err != nil {
+		return nil, err
+	}
+	bootscript := one.Bootscript.bootscript()
+
+	return &bootscript, nil
+}
+
+func (a *instanceAPI) GetBootscripts() (*[]scw.ScalewayBootscript, error) {
+	var bootscripts []scw.ScalewayBootscript
+	err := a.list("bootscripts", func(query url.Values) (int, error) {
+		var page struct {
+			Bootscripts []instanceBootscript `json:"bootscripts"`
+		}
+		if err := a.do("GET", a.zoned("bootscripts"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		for _, b := range page.Bootscripts {
+			bootscripts = append(bootscripts, b.bootscript())
+		}
+
+		return len(page.Bootscripts), nil
+	})
+
+	return &bootscripts, err
+}
+
+// GetBootscriptID returns the only bootscript titled or identified by needle
+// which boots arch.
+func (a *instanceAPI) GetBootscriptID(needle, arch string) (string, error) {
+	bootscripts, err := a.GetBootscripts()
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, bootscript := range *bootscripts {
+		if bootscript.Arch == arch && (bootscript.Identifier == needle || strings.EqualFold(bootscript.Title, needle)) {
+			found = append(found, bootscript.Identifier)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("No such bootscript: %s", needle)
+	case 1:
+		return found[0], nil
+	}
+
+	return "", fmt.Errorf("bootscript %s is ambiguous, use one of these ids: %s", needle, strings.Join(found, ", "))
+}
+
+func (a *instanceAPI) GetServers(all bool, limit int) (*[]scw.ScalewayServer, error) {
+	var servers []scw.ScalewayServer
+	err := a.list("servers", func(query url.Values) (int, error) {
+		if !all {
+			query.Set("state", "running")
+		}
+
+		var page scw.ScalewayServers
+		if err := a.do("GET", a.zoned("servers"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		servers = append(servers, page.Servers...)
+
+		return len(page.Servers), nil
+	})
+
+	return &servers, err
+}
+
+func (a *instanceAPI) GetServer(serverID string) (*scw.ScalewayServer, error) {
+	var one scw.ScalewayOneServer
+	err := a.do("GET", a.zoned("servers/"+serverID), nil, nil, &one, http.StatusOK)
+
+	return &one.Server, err
+}
+
+// PostServer creates a server. The Instance API takes volume templates rather
+// than bare ids.
+func (a *instanceAPI) PostServer(definition scw.ScalewayServerDefinition) (string, error) {
+	volumes := make(map[string]map[string]string)
+	for idx, id := range definition.Volumes {
+		volumes[idx] = map[string]string{"id": id}
+	}
+
+	body := map[string]interface{}{
+		"name":            definition.Name,
+		"commercial_type": definition.CommercialType,
+		"project":         a.projectID,
+		"enable_ipv6":     definition.EnableIPV6,
+		"tags":            definition.Tags,
+	}
+	if definition.Image != nil {
+		body["image"] = *definition.Image
+	}
+	if len(volumes) > 0 {
+		body["volumes"] = volumes
+	}
+	if definition.DynamicIPRequired != nil {
+		body["dynamic_ip_required"] = *definition.DynamicIPRequired
+	}
+	if definition.PublicIP != "" {
+		body["public_ip"] = definition.PublicIP
+	}
+	if definition.SecurityGroup != "" {
+		body["security_group"] = definition.SecurityGroup
+	}
+	if definition.Bootscript != nil {
+		body["bootscript"] = *definition.Bootscript
+		body["boot_type"] = "bootscript"
+	}
+
+	var one scw.ScalewayOneServer
+	err := a.do("POST", a.zoned("servers"), nil, body, &one, http.StatusCreated)
+
+	return one.Server.Identifier, err
+}
+
+func (a *instanceAPI) PatchServer(serverID string, definition scw.ScalewayServerPatchDefinition) error {
+	return a.do("PATCH", a.zoned("servers/"+serverID), nil, definition, nil, http.StatusOK)
+}
+
+// PatchServerBootType sets the boot type of the server, local or bootscript.
+func (a *instanceAPI) PatchServerBootType(serverID, bootType string) error {
+	body := map[string]string{"boot_type": bootType}
+	return a.do("PATCH", a.zoned("servers/"+serverID), nil, body, nil, http.StatusOK)
+}
+
+func (a *instanceAPI) PostServerAction(serverID, action string) error {
+	body := map[string]string{"action": action}
+	return a.do("POST", a.zoned("servers/"+serverID+"/action"), nil, body, nil, http.StatusAccepted)
+}
+
+// DeleteServerForce deletes the server, or terminates it when it cannot be
+// deleted, like its scw.ScalewayAPI counterpart.
+func (a *instanceAPI) DeleteServerForce(serverID string) error {
+	err := a.do("DELETE", a.zoned("servers/"+serverID), nil, nil, nil, http.StatusNoContent)
+	if err == nil || isNotFound(err) {
+		return err
+	}
+
+	return a.PostServerAction(serverID, "terminate")
+}
+
+func (a *instanceAPI) PatchUserdata(serverID, key string, value []byte, metadata bool) error {
+	return a.do("PATCH", a.zoned("servers/"+serverID+"/user_data/"+key), nil, value, nil, http.StatusNoContent)
+}
+
+func (a *instanceAPI) GetSSHFingerprintFromServer(serverID string) []string {
+	ret := []string{}
+
+	var value []byte
+	if err := a.do("GET", a.zoned("servers/"+serverID+"/user_data/ssh-host-fingerprints"), nil, nil, &value, http.StatusOK); err == nil {
+		for _, key := range strings.Split(string(value), "\n") {
+			if fingerprint, err := utils.SSHGetFingerprint([]byte(key)); err == nil {
+				ret = append(ret, fingerprint)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (a *instanceAPI) NewIP() (*scw.ScalewayGetIP, error) {
+	var ip scw.ScalewayGetIP
+	body := map[string]string{"project": a.projectID}
+	err := a.do("POST", a.zoned("ips"), nil, body, &ip, http.StatusCreated)
+
+	return &ip, err
+}
+
+func (a *instanceAPI) GetIP(ipID string) (*scw.ScalewayGetIP, error) {
+	var ip scw.ScalewayGetIP
+	err := a.do("GET", a.zoned("ips/"+ipID), nil, nil, &ip, http.StatusOK)
+
+	return &ip, err
+}
+
+func (a *instanceAPI) GetIPS() (*scw.ScalewayGetIPS, error) {
+	var ips scw.ScalewayGetIPS
+	err := a.list("ips", func(query url.Values) (int, error) {
+		var page scw.ScalewayGetIPS
+		if err := a.do("GET", a.zoned("ips"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		ips.IPS = append(ips.IPS, page.IPS...)
+
+		return len(page.IPS), nil
+	})
+
+	return &ips, err
+}
+
+func (a *instanceAPI) DeleteIP(ipID string) error {
+	return a.do("DELETE", a.zoned("ips/"+ipID), nil, nil, nil, http.StatusNoContent)
+}
+
+func (a *instanceAPI) PostVolume(definition scw.ScalewayVolumeDefinition) (string, error) {
+	if definition.Type == "" {
+		definition.Type = "l_ssd"
+	}
+
+	body := map[string]interface{}{
+		"name":        definition.Name,
+		"size":        definition.Size,
+		"volume_type": definition.Type,
+		"project":     a.projectID,
+	}
+
+	var one scw.ScalewayOneVolume
+	err := a.do("POST", a.zoned("volumes"), nil, body, &one, http.StatusCreated)
+
+	return one.Volume.Identifier, err
+}
+
+// PostVolumeFromSnapshot creates a volume holding a copy of the snapshot.
+func (a *instanceAPI) PostVolumeFromSnapshot(snapshotID, name, volumeType string) (string, error) {
+	body := map[string]interface{}{
+		"name":          name,
+		"base_snapshot": snapshotID,
+		"volume_type":   volumeType,
+		"project":       a.projectID,
+	}
+
+	var one scw.ScalewayOneVolume
+	err := a.do("POST", a.zoned("volumes"), nil, body, &one, http.StatusCreated)
+
+	return one.Volume.Identifier, err
+}
+
+func (a *instanceAPI) GetVolume(volumeID string) (*scw.ScalewayVolume, error) {
+	var one scw.ScalewayOneVolume
+	err := a.do("GET", a.zoned("volumes/"+volumeID), nil, nil, &one, http.StatusOK)
+
+	return &one.Volume, err
+}
+
+func (a *instanceAPI) GetVolumes() (*[]scw.ScalewayVolume, error) {
+	var volumes []scw.ScalewayVolume
+	err := a.list("volumes", func(query url.Values) (int, error) {
+		var page scw.ScalewayVolumes
+		if err := a.do("GET", a.zoned("volumes"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		volumes = append(volumes, page.Volumes...)
+
+		return len(page.Volumes), nil
+	})
+
+	return &volumes, err
+}
+
+func (a *instanceAPI) GetSnapshot(snapshotID string) (*scw.ScalewaySnapshot, error) {
+	var one scw.ScalewayOneSnapshot
+	err := a.do("GET", a.zoned("snapshots/"+snapshotID), nil, nil, &one, http.StatusOK)
+
+	return &one.Snapshot, err
+}
+
+func (a *instanceAPI) GetSnapshots() (*[]scw.ScalewaySnapshot, error) {
+	var snapshots []scw.ScalewaySnapshot
+	err := a.list("snapshots", func(query url.Values) (int, error) {
+		var page scw.ScalewaySnapshots
+		if err := a.do("GET", a.zoned("snapshots"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		snapshots = append(snapshots, page.Snapshots...)
+
+		return len(page.Snapshots), nil
+	})
+
+	return &snapshots, err
+}
+
+func (a *instanceAPI) PostSnapshot(volumeID, name string) (string, error) {
+	body := map[string]string{
+		"volume_id": volumeID,
+		"name":      name,
+		"project":   a.projectID,
+	}
+
+	var one scw.ScalewayOneSnapshot
+	err := a.do("POST", a.zoned("snapshots"), nil, body, &one, http.StatusCreated)
+
+	return one.Snapshot.Identifier, err
+}
+
+func (a *instanceAPI) DeleteVolume(volumeID string) error {
+	return a.do("DELETE", a.zoned("volumes/"+volumeID), nil, nil, nil, http.StatusNoContent)
+}
+
+func (a *instanceAPI) GetSecurityGroups() (*scw.ScalewayGetSecurityGroups, error) {
+	var groups scw.ScalewayGetSecurityGroups
+	err := a.list("security_groups", func(query url.Values) (int, error) {
+		var page scw.ScalewayGetSecurityGroups
+		if err := a.do("GET", a.zoned("security_groups"), query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		groups.SecurityGroups = append(groups.SecurityGroups, page.SecurityGroups...)
+
+		return len(page.SecurityGroups), nil
+	})
+
+	return &groups, err
+}
+
+// PostSecurityGroup creates a stateful security group dropping the inbound
+// traffic its rules do not accept.
+func (a *instanceAPI) PostSecurityGroup(group scw.ScalewayNewSecurityGroup) error {
+	body := map[string]interface{}{
+		"name":                    group.Name,
+		"description":             group.Description,
+		"project":                 a.projectID,
+		"stateful":                true,
+		"inbound_default_policy":  "drop",
+		"outbound_default_policy": "accept",
+	}
+
+	return a.do("POST", a.zoned("security_groups"), nil, body, nil, http.StatusCreated)
+}
+
+func (a *instanceAPI) PostSecurityGroupRule(securityGroupID string, rule scw.ScalewayNewSecurityGroupRule) error {
+	return a.do("POST", a.zoned("security_groups/"+securityGroupID+"/rules"), nil, rule, nil, http.StatusCreated)
+}
+
+func (a *instanceAPI) DeleteSecurityGroup(securityGroupID string) error {
+	return a.do("DELETE", a.zoned("security_groups/"+securityGroupID), nil, nil, nil, http.StatusNoContent)
+}
@@ -0,0 +1,164 @@
+package scaleway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/commands/commandstest"
+	"github.com/docker/machine/libmachine/state"
+)
+
+func TestInstanceAPIFlags(t *testing.T) {
+	for _, tc := range []struct {
+		flags map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{
+			"scaleway-access-key": testAccessKey,
+			"scaleway-secret-key": testToken,
+			"scaleway-project-id": testProjectID,
+		}, true},
+		{map[string]interface{}{
+			"scaleway-secret-key": testToken,
+			"scaleway-project-id": testProjectID,
+		}, false},
+		{map[string]interface{}{
+			"scaleway-access-key": testAccessKey,
+			"scaleway-secret-key": testToken,
+		}, false},
+		{map[string]interface{}{
+			"scaleway-token":      testToken,
+			"scaleway-access-key": testAccessKey,
+			"scaleway-secret-key": testToken,
+			"scaleway-project-id": testProjectID,
+		}, false},
+		{map[string]interface{}{
+			"scaleway-access-key": testAccessKey,
+			"scaleway-project-id": testProjectID,
+		}, false},
+	} {
+		td := NewDriver(testMachineName, testStorePath).(*Driver)
+		err := td.SetConfigFromFlags(&commandstest.FakeFlagger{Data: tc.flags})
+
+		if (err == nil) != tc.valid {
+			t.Errorf("Expecting %v to be valid: %v, got '%v'\n", tc.flags, tc.valid, err)
+		}
+
+		if err == nil && td.Zone != defaultZone {
+			t.Errorf("Expecting '%s', got '%s'\n", defaultZone, td.Zone)
+		}
+	}
+}
+
+func TestInstanceAPILifecycle(t *testing.T) {
+	for _, zone := range zones {
+		f := newFakeAPI()
+
+		td := f.newInstanceDriver(zone)
+		td.Volumes = "10G"
+		td.CreateSecurityGroup = true
+
+		if err := td.PreCreateCheck(); err != nil {
+			t.Fatalf("%s: %v", zone, err)
+		}
+
+		if err := td.Create(); err != nil {
+			t.Fatalf("%s: %v", zone, err)
+		}
+
+		server := f.server(td.ServerID)
+		if server == nil || server.Organization != testProjectID {
+			t.Fatalf("%s: expecting server '%s' in project '%s'\n", zone, td.ServerID, testProjectID)
+		}
+
+		if len(server.Volumes) != 2 {
+			t.Errorf("%s: expecting 2 volumes, got %d\n", zone, len(server.Volumes))
+		}
+
+		for _, step := range []struct {
+			name     string
+			action   func() error
+			expected state.State
+		}{
+			{"Stop", td.Stop, state.Stopped},
+			{"Start", td.Start, state.Running},
+		} {
+			if err := step.action(); err != nil {
+				t.Fatalf("%s: %s: %v", zone, step.name, err)
+			}
+
+			if actual, err := td.GetState(); err != nil || actual != step.expected {
+				t.Errorf("%s: %s: expecting '%s', got '%s' (%v)\n", zone, step.name, step.expected, actual, err)
+			}
+		}
+
+		if err := td.Remove(); err != nil {
+			t.Fatalf("%s: %v", zone, err)
+		}
+
+		if res := f.resources(); len(res) > 0 {
+			t.Errorf("%s: expecting every resource to be removed, got %v\n", zone, res)
+		}
+
+		if n := f.served("compute") + f.served("account"); n > 0 {
+			t.Errorf("%s: expecting the legacy APIs not to be used, got %d requests\n", zone, n)
+		}
+
+		f.close()
+	}
+}
+
+func TestInstanceAPIPreCreateCheck(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newInstanceDriver("fr-par-2")
+	if err := td.PreCreateCheck(); err == nil || !strings.Contains(err.Error(), "unknown zone fr-par-2") {
+		t.Errorf("Expecting the zone to be rejected, got '%v'\n", err)
+	}
+
+	td = f.newInstanceDriver(defaultZone)
+	td.AccessKey = "SCWYYYYYYYYYYYYYYYYY"
+	if err := td.PreCreateCheck(); err == nil {
+		t.Error("Expecting an unknown access key to be rejected")
+	}
+
+	td = f.newInstanceDriver(defaultZone)
+	td.Image = "ubuntu-xenail"
+	if err := td.PreCreateCheck(); err == nil || !strings.Contains(err.Error(), "in fr-par-1, did you mean ubuntu-xenial?") {
+		t.Errorf("Expecting the image to be looked up in the zone, got '%v'\n", err)
+	}
+}
+
+func TestInstanceAPIRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Reset", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message": "quota exceeded", "type": "too_many_requests"}`))
+	}))
+	defer srv.Close()
+
+	api := newInstanceAPI(defaultZone, testAccessKey, testToken, testProjectID)
+	api.url = srv.URL
+
+	err := api.DeleteIP(testReservedIPID)
+	e, ok := err.(rateLimitedError)
+	if !ok {
+		t.Fatalf("Expecting a rate limited error, got '%v'\n", err)
+	}
+
+	if e.StatusCode != http.StatusTooManyRequests || e.APIMessage != "quota exceeded" {
+		t.Errorf("Expecting a 429 'quota exceeded' error, got '%v'\n", e)
+	}
+
+	if e.RetryAfter() != 2*time.Second {
+		t.Errorf("Expecting to retry after 2s, got %s\n", e.RetryAfter())
+	}
+
+	if !transient(err, false) {
+		t.Error("Expecting a rate limited error to be transient")
+	}
+}
@@ -0,0 +1,621 @@
+package scaleway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+	"github.com/scaleway/scaleway-cli/pkg/utils"
+)
+
+const legacyPerPage = 50
+
+// legacyAPI speaks the regional compute API, authenticated with a token and
+// scoped to an organization, at the endpoints of the scaleway-cli API package.
+// It sends the requests itself rather than through scw.ScalewayAPI, whose
+// errors drop the status code and rate-limit headers of the responses.
+type legacyAPI struct {
+	computeURL   string
+	region       string
+	organization string
+	token        string
+	cache        *scw.ScalewayCache
+	http         *http.Client
+}
+
+// newLegacyAPI returns a client of the region, which resolves names through
+// cache.
+func newLegacyAPI(organization, token, region string, cache *scw.ScalewayCache) (*legacyAPI, error) {
+	api := &legacyAPI{
+		region:       region,
+		organization: organization,
+		token:        token,
+		cache:        cache,
+		http:         newHTTPClient(),
+	}
+
+	switch region {
+	case "par1", "":
+		api.computeURL = scw.ComputeAPIPar1
+	case "ams1":
+		api.computeURL = scw.ComputeAPIAms1
+	default:
+		return nil, fmt.Errorf("%s isn't a valid region", region)
+	}
+
+	if u := os.Getenv("SCW_COMPUTE_API"); u != "" {
+		api.computeURL = u
+	}
+
+	return api, nil
+}
+
+// do sends a request to the resource of the API at endpoint.
+func (a *legacyAPI) do(method, endpoint, resource string, query url.Values, body, out interface{}, expected int) error {
+	return send(a.http, a.token, method, strings.TrimRight(endpoint, "/")+"/"+resource, query, body, out, expected)
+}
+
+func (a *legacyAPI) compute(method, resource string, query url.Values, body, out interface{}, expected int) error {
+	return a.do(method, a.computeURL, resource, query, body, out, expected)
+}
+
+// list fetches every page of a collection. fetch decodes a page and returns
+// how many items it held.
+func (a *legacyAPI) list(query url.Values, fetch func(query url.Values) (int, error)) error {
+	for page := 1; ; page++ {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("page", strconv.Itoa(page))
+		q.Set("per_page", strconv.Itoa(legacyPerPage))
+
+		n, err := fetch(q)
+		if err != nil || n < legacyPerPage {
+			return err
+		}
+	}
+}
+
+// CheckCredentials looks for the token among those of the account, on every
+// page.
+func (a *legacyAPI) CheckCredentials() error {
+	found := false
+	err := a.list(nil, func(query url.Values) (int, error) {
+		var page scw.ScalewayGetTokens
+		if err := a.do("GET", scw.AccountAPI, "tokens", query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+
+		for _, token := range page.Tokens {
+			found = found || token.ID == a.token
+		}
+
+		// The token is found, no need for the next pages.
+		if found {
+			return 0, nil
+		}
+		return len(page.Tokens), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errors.New("Invalid token")
+	}
+
+	return nil
+}
+
+func (a *legacyAPI) GetQuotas() (*scw.ScalewayGetQuotas, error) {
+	var quotas scw.ScalewayGetQuotas
+	err := a.do("GET", scw.AccountAPI, "organizations/"+a.organization+"/quotas", nil, nil, &quotas, http.StatusOK)
+
+	return &quotas, err
+}
+
+func (a *legacyAPI) GetProductsServers() (*scw.ScalewayProductsServers, error) {
+	var products scw.ScalewayProductsServers
+	err := a.compute("GET", "products/servers", nil, nil, &products, http.StatusOK)
+
+	return &products, err
+}
+
+func (a *legacyAPI) GetImage(imageID string) (*scw.ScalewayImage, error) {
+	var one scw.ScalewayOneImage
+	if err := a.compute("GET", "images/"+imageID, nil, nil, &one, http.StatusOK); err != nil {
+		return nil, err
+	}
+	a.cache.InsertImage(one.Image.Identifier, a.region, one.Image.Arch, one.Image.Organization, one.Image.Name, "")
+
+	return &one.Image, nil
+}
+
+// PostImage creates an image of the snapshot volumeID.
+func (a *legacyAPI) PostImage(volumeID, name, bootscript, arch string) (string, error) {
+	definition := scw.ScalewayImageDefinition{
+		SnapshotIDentifier: volumeID,
+		Name:               name,
+		Organization:       a.organization,
+		Arch:               arch,
+	}
+	if bootscript != "" {
+		definition.DefaultBootscript = &bootscript
+	}
+
+	var one scw.ScalewayOneImage
+	err := a.compute("POST", "images", nil, definition, &one, http.StatusCreated)
+
+	return one.Image.Identifier, err
+}
+
+// GetImages lists the marketplace images and the images of the organization,
+// and records them in the cache.
+func (a *legacyAPI) GetImages() (*[]scw.MarketImage, error) {
+	var market scw.MarketImages
+	if err := a.do("GET", scw.MarketplaceAPI, "images/", nil, nil, &market, http.StatusOK); err != nil {
+		return nil, err
+	}
+	images := market.Images
+
+	a.cache.ClearImages()
+	for i, image := range images {
+		for _, version := range image.Versions {
+			if version.ID != image.CurrentPublicVersion {
+				continue
+			}
+
+			for _, local := range version.LocalImages {
+				images[i].Public = true
+				a.cache.InsertImage(local.ID, local.Zone, local.Arch, image.Organization.ID, image.Name, image.CurrentPublicVersion)
+			}
+		}
+	}
+
+	var own scw.ScalewayImages
+	query := url.Values{"organization": {a.organization}}
+	if err := a.compute("GET", "images", query, nil, &own, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	for _, img := range own.Images {
+		m := scw.MarketImage{Name: img.Name, CurrentPublicVersion: img.Identifier, Categories: []string{"MyImages"}}
+		m.Versions = []scw.MarketVersionDefinition{{ID: img.Identifier}}
+		m.Versions[0].LocalImages = []scw.MarketLocalImageDefinition{
+			{ID: img.Identifier, Arch: img.Arch, Zone: a.region},
+		}
+		images = append(images, m)
+		a.cache.InsertImage(img.Identifier, a.region, img.Arch, img.Organization, img.Name, "")
+	}
+
+	return &images, nil
+}
+
+// GetImageID returns the only image matching needle which runs on arch in the
+// region, looking it up in the cache before listing the images.
+func (a *legacyAPI) GetImageID(needle, arch string) (*scw.ScalewayImageIdentifier, error) {
+	needle = strings.TrimPrefix(needle, "image:")
+
+	images, err := a.cache.LookUpImages(needle, true)
+	if err == nil && len(images) == 0 {
+		if _, err = a.GetImages(); err != nil {
+			return nil, err
+		}
+		images, err = a.cache.LookUpImages(needle, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve image %s: %s", needle, err)
+	}
+
+	images = scw.FilterImagesByArch(images, arch)
+	images = scw.FilterImagesByRegion(images, a.region)
+
+	switch len(images) {
+	case 0:
+		return nil, fmt.Errorf("No such image (zone %s, arch %s) : %s", a.region, arch, needle)
+	case 1:
+		return &scw.ScalewayImageIdentifier{Identifier: images[0].Identifier, Arch: images[0].Arch, Region: images[0].Region}, nil
+	}
+
+	return nil, fmt.Errorf("image %s is ambiguous, use one of these ids: %s", needle, strings.Join(resultIDs(images), ", "))
+}
+
+func (a *legacyAPI) GetBootscript(bootscriptID string) (*scw.ScalewayBootscript, error) {
+	var one scw.ScalewayOneBootscript
+	if err := a.compute("GET", "bootscripts/"+bootscriptID, nil, nil, &one, http.StatusOK); err != nil {
+		return nil, err
+	}
+	b := one.Bootscript
+	a.cache.InsertBootscript(b.Identifier, "", b.Arch, b.Organization, b.Title)
+
+	return &b, nil
+}
+
+func (a *legacyAPI) GetBootscripts() (*[]scw.ScalewayBootscript, error) {
+	var bootscripts []scw.ScalewayBootscript
+	err := a.list(nil, func(query url.Values) (int, error) {
+		var page scw.ScalewayBootscripts
+		if err := a.compute("GET", "bootscripts", query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		bootscripts = append(bootscripts, page.Bootscripts...)
+
+		return len(page.Bootscripts), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.cache.ClearBootscripts()
+	for _, b := range bootscripts {
+		a.cache.InsertBootscript(b.Identifier, "", b.Arch, b.Organization, b.Title)
+	}
+
+	return &bootscripts, nil
+}
+
+// GetBootscriptID returns the only bootscript matching needle which boots
+// arch, looking it up in the cache before listing the bootscripts.
+func (a *legacyAPI) GetBootscriptID(needle, arch string) (string, error) {
+	needle = strings.TrimPrefix(needle, "bootscript:")
+
+	bootscripts, err := a.cache.LookUpBootscripts(needle, true)
+	if err == nil && len(bootscripts) == 0 {
+		if _, err = a.GetBootscripts(); err != nil {
+			return "", err
+		}
+		bootscripts, err = a.cache.LookUpBootscripts(needle, true)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve bootscript %s: %s", needle, err)
+	}
+
+	bootscripts.FilterByArch(arch)
+
+	switch len(bootscripts) {
+	case 0:
+		return "", fmt.Errorf("No such bootscript: %s", needle)
+	case 1:
+		return bootscripts[0].Identifier, nil
+	}
+
+	return "", fmt.Errorf("bootscript %s is ambiguous, use one of these ids: %s", needle, strings.Join(resultIDs(bootscripts), ", "))
+}
+
+func resultIDs(results scw.ScalewayResolverResults) []string {
+	var ids []string
+	for _, r := range results {
+		ids = append(ids, r.Identifier)
+	}
+
+	return ids
+}
+
+// GetServers lists the servers of both regions, like its scw.ScalewayAPI
+// counterpart.
+func (a *legacyAPI) GetServers(all bool, limit int) (*[]scw.ScalewayServer, error) {
+	query := url.Values{}
+	if !all {
+		query.Set("state", "running")
+	}
+
+	var servers []scw.ScalewayServer
+	for _, endpoint := range legacyRegionURLs() {
+		err := a.list(query, func(query url.Values) (int, error) {
+			var page scw.ScalewayServers
+			if err := a.do("GET", endpoint, "servers", query, nil, &page, http.StatusOK); err != nil {
+				return 0, err
+			}
+			servers = append(servers, page.Servers...)
+
+			return len(page.Servers), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range servers {
+		setServerDNS(&servers[i])
+	}
+
+	return &servers, nil
+}
+
+// legacyRegionURLs returns the compute endpoints of every region.
+func legacyRegionURLs() []string {
+	return []string{scw.ComputeAPIPar1, scw.ComputeAPIAms1}
+}
+
+func setServerDNS(server *scw.ScalewayServer) {
+	server.DNSPublic = server.Identifier + scw.URLPublicDNS
+	server.DNSPrivate = server.Identifier + scw.URLPrivateDNS
+}
+
+func (a *legacyAPI) GetServer(serverID string) (*scw.ScalewayServer, error) {
+	if serverID == "" {
+		return nil, fmt.Errorf("cannot get server without serverID")
+	}
+
+	var one scw.ScalewayOneServer
+	if err := a.compute("GET", "servers/"+serverID, nil, nil, &one, http.StatusOK); err != nil {
+		return nil, err
+	}
+	setServerDNS(&one.Server)
+
+	return &one.Server, nil
+}
+
+func (a *legacyAPI) PostServer(definition scw.ScalewayServerDefinition) (string, error) {
+	definition.Organization = a.organization
+
+	var one scw.ScalewayOneServer
+	err := a.compute("POST", "servers", nil, definition, &one, http.StatusCreated)
+
+	return one.Server.Identifier, err
+}
+
+func (a *legacyAPI) PatchServer(serverID string, definition scw.ScalewayServerPatchDefinition) error {
+	return a.compute("PATCH", "servers/"+serverID, nil, definition, nil, http.StatusOK)
+}
+
+func (a *legacyAPI) PostServerAction(serverID, action string) error {
+	body := scw.ScalewayServerAction{Action: action}
+	return a.compute("POST", "servers/"+serverID+"/action", nil, body, nil, http.StatusAccepted)
+}
+
+// DeleteServerForce deletes the server, or terminates it when it cannot be
+// deleted, like its scw.ScalewayAPI counterpart.
+func (a *legacyAPI) DeleteServerForce(serverID string) error {
+	err := a.compute("DELETE", "servers/"+serverID, nil, nil, nil, http.StatusNoContent)
+	if err == nil {
+		return nil
+	}
+
+	return a.PostServerAction(serverID, "terminate")
+}
+
+func (a *legacyAPI) PatchUserdata(serverID, key string, value []byte, metadata bool) error {
+	endpoint, resource := a.computeURL, "servers/"+serverID+"/user_data/"+key
+	if metadata {
+		endpoint, resource = scw.MetadataAPI, "user_data/"+key
+	}
+
+	return a.do("PATCH", endpoint, resource, nil, value, nil, http.StatusNoContent)
+}
+
+func (a *legacyAPI) GetSSHFingerprintFromServer(serverID string) []string {
+	ret := []string{}
+
+	var value []byte
+	if err := a.compute("GET", "servers/"+serverID+"/user_data/ssh-host-fingerprints", nil, nil, &value, http.StatusOK); err == nil {
+		for _, key := range strings.Split(string(value), "\n") {
+			if fingerprint, err := utils.SSHGetFingerprint([]byte(key)); err == nil {
+				ret = append(ret, fingerprint)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (a *legacyAPI) NewIP() (*scw.ScalewayGetIP, error) {
+	var ip scw.ScalewayGetIP
+	body := map[string]string{"organization": a.organization}
+	err := a.compute("POST", "ips", nil, body, &ip, http.StatusCreated)
+
+	return &ip, err
+}
+
+func (a *legacyAPI) GetIP(ipID string) (*scw.ScalewayGetIP, error) {
+	var ip scw.ScalewayGetIP
+	err := a.compute("GET", "ips/"+ipID, nil, nil, &ip, http.StatusOK)
+
+	return &ip, err
+}
+
+func (a *legacyAPI) GetIPS() (*scw.ScalewayGetIPS, error) {
+	return a.ips(a.computeURL)
+}
+
+// GetOrganizationIPS lists the IPs of every region.
+func (a *legacyAPI) GetOrganizationIPS() (*scw.ScalewayGetIPS, error) {
+	var all scw.ScalewayGetIPS
+	for _, endpoint := range legacyRegionURLs() {
+		ips, err := a.ips(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		all.IPS = append(all.IPS, ips.IPS...)
+	}
+
+	return &all, nil
+}
+
+func (a *legacyAPI) ips(endpoint string) (*scw.ScalewayGetIPS, error) {
+	var ips scw.ScalewayGetIPS
+	err := a.list(nil, func(query url.Values) (int, error) {
+		var page scw.ScalewayGetIPS
+		if err := a.do("GET", endpoint, "ips", query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		ips.IPS = append(ips.IPS, page.IPS...)
+
+		return len(page.IPS), nil
+	})
+
+	return &ips, err
+}
+
+func (a *legacyAPI) DeleteIP(ipID string) error {
+	return a.compute("DELETE", "ips/"+ipID, nil, nil, nil, http.StatusNoContent)
+}
+
+func (a *legacyAPI) PostVolume(definition scw.ScalewayVolumeDefinition) (string, error) {
+	definition.Organization = a.organization
+	if definition.Type == "" {
+		definition.Type = "l_ssd"
+	}
+
+	var one scw.ScalewayOneVolume
+	err := a.compute("POST", "volumes", nil, definition, &one, http.StatusCreated)
+
+	return one.Volume.Identifier, err
+}
+
+// PostVolumeFromSnapshot creates a volume holding a copy of the snapshot.
+func (a *legacyAPI) PostVolumeFromSnapshot(snapshotID, name, volumeType string) (string, error) {
+	body := map[string]interface{}{
+		"name":          name,
+		"base_snapshot": snapshotID,
+		"volume_type":   volumeType,
+		"organization":  a.organization,
+	}
+
+	var one scw.ScalewayOneVolume
+	err := a.compute("POST", "volumes", nil, body, &one, http.StatusCreated)
+
+	return one.Volume.Identifier, err
+}
+
+func (a *legacyAPI) GetVolume(volumeID string) (*scw.ScalewayVolume, error) {
+	var one scw.ScalewayOneVolume
+	err := a.compute("GET", "volumes/"+volumeID, nil, nil, &one, http.StatusOK)
+
+	return &one.Volume, err
+}
+
+func (a *legacyAPI) GetVolumes() (*[]scw.ScalewayVolume, error) {
+	return a.volumes(a.computeURL)
+}
+
+// GetOrganizationVolumes lists the volumes of every region.
+func (a *legacyAPI) GetOrganizationVolumes() (*[]scw.ScalewayVolume, error) {
+	var all []scw.ScalewayVolume
+	for _, endpoint := range legacyRegionURLs() {
+		volumes, err := a.volumes(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *volumes...)
+	}
+
+	return &all, nil
+}
+
+func (a *legacyAPI) volumes(endpoint string) (*[]scw.ScalewayVolume, error) {
+	var volumes []scw.ScalewayVolume
+	err := a.list(nil, func(query url.Values) (int, error) {
+		var page scw.ScalewayVolumes
+		if err := a.do("GET", endpoint, "volumes", query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		volumes = append(volumes, page.Volumes...)
+
+		return len(page.Volumes), nil
+	})
+
+	return &volumes, err
+}
+
+func (a *legacyAPI) DeleteVolume(volumeID string) error {
+	return a.compute("DELETE", "volumes/"+volumeID, nil, nil, nil, http.StatusNoContent)
+}
+
+func (a *legacyAPI) GetSnapshot(snapshotID string) (*scw.ScalewaySnapshot, error) {
+	var one scw.ScalewayOneSnapshot
+	err := a.compute("GET", "snapshots/"+snapshotID, nil, nil, &one, http.StatusOK)
+
+	return &one.Snapshot, err
+}
+
+func (a *legacyAPI) GetSnapshots() (*[]scw.ScalewaySnapshot, error) {
+	var snapshots []scw.ScalewaySnapshot
+	err := a.list(nil, func(query url.Values) (int, error) {
+		var page scw.ScalewaySnapshots
+		if err := a.compute("GET", "snapshots", query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		snapshots = append(snapshots, page.Snapshots...)
+
+		return len(page.Snapshots), nil
+	})
+
+	return &snapshots, err
+}
+
+func (a *legacyAPI) PostSnapshot(volumeID, name string) (string, error) {
+	definition := scw.ScalewaySnapshotDefinition{
+		VolumeIDentifier: volumeID,
+		Name:             name,
+		Organization:     a.organization,
+	}
+
+	var one scw.ScalewayOneSnapshot
+	err := a.compute("POST", "snapshots", nil, definition, &one, http.StatusCreated)
+
+	return one.Snapshot.Identifier, err
+}
+
+func (a *legacyAPI) GetSecurityGroups() (*scw.ScalewayGetSecurityGroups, error) {
+	var groups scw.ScalewayGetSecurityGroups
+	err := a.list(nil, func(query url.Values) (int, error) {
+		var page scw.ScalewayGetSecurityGroups
+		if err := a.compute("GET", "security_groups", query, nil, &page, http.StatusOK); err != nil {
+			return 0, err
+		}
+		groups.SecurityGroups = append(groups.SecurityGroups, page.SecurityGroups...)
+
+		return len(page.SecurityGroups), nil
+	})
+
+	return &groups, err
+}
+
+// PostSecurityGroup creates a stateful security group dropping the inbound
+// traffic its rules do not accept.
+func (a *legacyAPI) PostSecurityGroup(group scw.ScalewayNewSecurityGroup) error {
+	body := map[string]interface{}{
+		"organization":            a.organization,
+		"name":                    group.Name,
+		"description":             group.Description,
+		"stateful":                true,
+		"inbound_default_policy":  "drop",
+		"outbound_default_policy": "accept",
+	}
+
+	return a.compute("POST", "security_groups", nil, body, nil, http.StatusCreated)
+}
+
+func (a *legacyAPI) PostSecurityGroupRule(securityGroupID string, rule scw.ScalewayNewSecurityGroupRule) error {
+	return a.compute("POST", "security_groups/"+securityGroupID+"/rules", nil, rule, nil, http.StatusCreated)
+}
+
+func (a *legacyAPI) DeleteSecurityGroup(securityGroupID string) error {
+	return a.compute("DELETE", "security_groups/"+securityGroupID, nil, nil, nil, http.StatusNoContent)
+}
+
+// GetUser returns the user owning the token.
+func (a *legacyAPI) GetUser() (*scw.ScalewayUserDefinition, error) {
+	var token scw.ScalewayTokensDefinition
+	if err := a.do("GET", scw.AccountAPI, "tokens/"+a.token, nil, nil, &token, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var user scw.ScalewayUsersDefinition
+	if err := a.do("GET", scw.AccountAPI, "users/"+token.Token.UserID, nil, nil, &user, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	return &user.User, nil
+}
+
+func (a *legacyAPI) PatchUserSSHKey(userID string, definition scw.ScalewayUserPatchSSHKeyDefinition) error {
+	return a.do("PATCH", scw.AccountAPI, "users/"+userID, nil, definition, nil, http.StatusOK)
+}
@@ -0,0 +1,99 @@
+package scaleway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+func TestLegacyAPIErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "DELETE":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message": "quota exceeded", "type": "too_many_requests"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+		}
+	}))
+	defer srv.Close()
+
+	api, err := newLegacyAPI(testOrganization, testToken, defaultRegion, &scw.ScalewayCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.computeURL = srv.URL
+
+	err = api.DeleteIP(testReservedIPID)
+	if e, ok := err.(rateLimitedError); !ok || e.StatusCode != http.StatusTooManyRequests || e.RetryAfter() != 3*time.Second {
+		t.Errorf("Expecting a 429 error retried after 3s, got '%v'\n", err)
+	}
+
+	_, err = api.GetIP(testReservedIPID)
+	if e, ok := err.(scw.ScalewayAPIError); !ok || e.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expecting a 502 error, got '%v'\n", err)
+	}
+
+	if !transient(err, true) || transient(err, false) {
+		t.Error("Expecting a gateway error to be transient for idempotent requests only")
+	}
+}
+
+func TestLegacyAPICheckCredentialsPages(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	// The token is on the second page.
+	var pages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+
+		var tokens scw.ScalewayGetTokens
+		if page == "1" {
+			for i := 0; i < legacyPerPage; i++ {
+				tokens.Tokens = append(tokens.Tokens, scw.ScalewayTokenDefinition{ID: fmt.Sprintf("other-%d", i)})
+			}
+		} else {
+			tokens.Tokens = append(tokens.Tokens, scw.ScalewayTokenDefinition{ID: testToken})
+		}
+		f.reply(w, http.StatusOK, tokens)
+	}))
+	defer srv.Close()
+	f.setvar(&scw.AccountAPI, srv.URL)
+
+	api, err := newLegacyAPI(testOrganization, testToken, defaultRegion, &scw.ScalewayCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = api.CheckCredentials(); err != nil || len(pages) != 2 {
+		t.Errorf("Expecting the token to be found on the second page, got %v after pages %v\n", err, pages)
+	}
+
+	api.token = "unknown"
+	if err = api.CheckCredentials(); err == nil {
+		t.Error("Expecting an unknown token to be rejected")
+	}
+}
+
+func TestHTTPClientTLSVerify(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	if newHTTPClient().Transport != nil {
+		t.Error("Expecting the default transport")
+	}
+
+	f.setenv("SCW_TLSVERIFY", "0")
+	transport, ok := newHTTPClient().Transport.(*http.Transport)
+	if !ok || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("Expecting SCW_TLSVERIFY=0 to skip the certificate verification")
+	}
+}
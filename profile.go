@@ -0,0 +1,281 @@
+package scaleway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/scaleway/scaleway-cli/pkg/config"
+)
+
+// legacyRegions maps the regions of the scw configuration file to the regions
+// of the legacy API.
+var legacyRegions = map[string]string{
+	"fr-par": "par1",
+	"nl-ams": "ams1",
+}
+
+// profile holds the credentials and defaults read from the scw configuration
+// files.
+type profile struct {
+	Organization string
+	Token        string
+	AccessKey    string
+	SecretKey    string
+	ProjectID    string
+	Region       string
+	Zone         string
+}
+
+// set assigns a key of the scw configuration file. Unknown keys are ignored.
+func (p *profile) set(key, value string) {
+	switch key {
+	case "access_key":
+		p.AccessKey = value
+	case "secret_key":
+		p.SecretKey = value
+	case "default_organization_id":
+		p.Organization = value
+	case "default_project_id":
+		p.ProjectID = value
+	case "default_region":
+		p.Region = value
+	case "default_zone":
+		p.Zone = value
+	}
+}
+
+// merge fills the empty fields of p from q.
+func (p *profile) merge(q *profile) {
+	for _, f := range []struct{ dst, src *string }{
+		{&p.Organization, &q.Organization},
+		{&p.Token, &q.Token},
+		{&p.AccessKey, &q.AccessKey},
+		{&p.SecretKey, &q.SecretKey},
+		{&p.ProjectID, &q.ProjectID},
+		{&p.Region, &q.Region},
+		{&p.Zone, &q.Zone},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+}
+
+// scwConfig is the content of ~/.config/scw/config.yaml: the default profile
+// at the top level, the named profiles and the active one.
+type scwConfig struct {
+	defaults profile
+	profiles map[string]*profile
+	active   string
+}
+
+// parseScwConfig reads the subset of YAML the scw tool writes: scalar keys at
+// the top level, and under profiles, one mapping of scalar keys per profile.
+// Other nested sections are skipped.
+func parseScwConfig(data []byte) (*scwConfig, error) {
+	c := &scwConfig{profiles: make(map[string]*profile)}
+
+	var section string
+	var current *profile
+	profileIndent := -1
+
+	for n, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expecting 'key: value'", n+1)
+		}
+		key, value := strings.TrimSpace(trimmed[:i]), yamlScalar(trimmed[i+1:])
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+		switch {
+		case indent == 0:
+			section, current, profileIndent = key, nil, -1
+			if key == "active_profile" {
+				c.active = value
+			} else {
+				c.defaults.set(key, value)
+			}
+		case section != "profiles":
+		case profileIndent < 0 || indent <= profileIndent:
+			current, profileIndent = &profile{}, indent
+			c.profiles[key] = current
+		default:
+			current.set(key, value)
+		}
+	}
+
+	return c, nil
+}
+
+// yamlScalar unquotes a scalar value, or strips its trailing comment.
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+
+	return s
+}
+
+// profile returns the named profile, or the active one when name is empty,
+// completed with the top level values. The default profile is the top level.
+func (c *scwConfig) profile(name string) (*profile, error) {
+	if name == "" {
+		name = c.active
+	}
+
+	p := c.defaults
+	if name == "" || (name == "default" && c.profiles[name] == nil) {
+		return &p, nil
+	}
+
+	named, ok := c.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %s", name)
+	}
+
+	q := *named
+	q.merge(&p)
+
+	return &q, nil
+}
+
+// scwConfigPath returns the path of the scw configuration file, which
+// SCW_CONFIG_PATH overrides.
+func scwConfigPath() (string, error) {
+	if path := os.Getenv("SCW_CONFIG_PATH"); path != "" {
+		return path, nil
+	}
+
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "scw", "config.yaml"), nil
+	}
+
+	home, err := config.GetHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".config", "scw", "config.yaml"), nil
+}
+
+// readProfile reads the named profile of the scw configuration file, then
+// completes it with the organization and token of ~/.scwrc. Missing files are
+// skipped, unless a profile is named.
+func readProfile(name string) (*profile, error) {
+	p := &profile{}
+
+	path, err := scwConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		c, err := parseScwConfig(data)
+		if err == nil {
+			p, err = c.profile(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	case name != "":
+		return nil, fmt.Errorf("no profile %s: %s does not exist", name, path)
+	}
+
+	rc, err := config.GetConfig()
+	switch {
+	case err == nil:
+		p.merge(&profile{Organization: rc.Organization, Token: rc.Token})
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("~/.scwrc: %v", err)
+	}
+
+	return p, nil
+}
+
+// loadProfile fills the options the flags left empty from the scw
+// configuration files. The credentials are taken as a whole: an API key when
+// the profile has one, the token of ~/.scwrc otherwise. The files are only
+// read when --scaleway-profile is given or the flags lack credentials, and
+// only fail the configuration in the first case.
+func (d *Driver) loadProfile() error {
+	if d.Profile == "" && d.hasCredentials() {
+		return nil
+	}
+
+	p, err := readProfile(d.Profile)
+	if err != nil {
+		if d.Profile != "" {
+			return err
+		}
+		log.Warnf("Cannot read the scw configuration: %v", err)
+		return nil
+	}
+
+	if d.Token == "" && d.SecretKey == "" {
+		if p.SecretKey != "" {
+			d.AccessKey, d.SecretKey = p.AccessKey, p.SecretKey
+		} else {
+			d.Token = p.Token
+		}
+	}
+
+	if d.useInstanceAPI() {
+		fill(&d.AccessKey, p.AccessKey)
+		fill(&d.ProjectID, p.ProjectID)
+		// Projects created along with an organization share its id.
+		fill(&d.ProjectID, p.Organization)
+		fill(&d.Zone, p.Zone)
+		return nil
+	}
+
+	fill(&d.Organization, p.Organization)
+	if region, ok := legacyRegions[p.Region]; ok {
+		fill(&d.Region, region)
+	} else {
+		fill(&d.Region, p.Region)
+	}
+
+	if d.Token == "" && d.Profile != "" {
+		return fmt.Errorf("profile %s has no credentials", d.Profile)
+	}
+
+	return nil
+}
+
+// hasCredentials tells whether the flags give the complete credentials of
+// either API.
+func (d *Driver) hasCredentials() bool {
+	if d.useInstanceAPI() {
+		return d.AccessKey != "" && d.ProjectID != ""
+	}
+
+	return d.Organization != "" && d.Token != ""
+}
+
+// fill sets *dst to value when it is empty.
+func fill(dst *string, value string) {
+	if *dst == "" {
+		*dst = value
+	}
+}
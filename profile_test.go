@@ -0,0 +1,246 @@
+package scaleway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/commands/commandstest"
+)
+
+const testScwConfig = `# scw configuration
+access_key: SCWDEFAULTXXXXXXXXXX
+secret_key: 11111111-1111-4111-8111-111111111111
+default_organization_id: ` + testOrganization + `
+default_region: nl-ams
+default_zone: nl-ams-1
+send_telemetry: false
+active_profile: work
+profiles:
+  work:
+    access_key: ` + testAccessKey + `
+    secret_key: "` + testToken + `"
+    default_project_id: '` + testProjectID + `'
+    default_zone: pl-waw-1 # Warsaw
+  legacy:
+    default_region: fr-par
+`
+
+// withHome points the configuration files lookup at a temporary home
+// directory, which the returned function removes.
+func withHome(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "scaleway-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restore []func()
+	for _, key := range []string{"HOME", "SCW_CONFIG_PATH", "XDG_CONFIG_HOME"} {
+		old, ok := os.LookupEnv(key)
+		key := key
+		restore = append(restore, func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+		os.Unsetenv(key)
+	}
+	os.Setenv("HOME", dir)
+
+	return dir, func() {
+		for _, r := range restore {
+			r()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseScwConfig(t *testing.T) {
+	c, err := parseScwConfig([]byte(testScwConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.active != "work" {
+		t.Errorf("Expecting 'work', got '%s'\n", c.active)
+	}
+
+	if c.defaults.Organization != testOrganization || c.defaults.Zone != "nl-ams-1" {
+		t.Errorf("Expecting the top level values, got %+v\n", c.defaults)
+	}
+
+	work := c.profiles["work"]
+	if work == nil || len(c.profiles) != 2 {
+		t.Fatalf("Expecting the work and legacy profiles, got %v\n", c.profiles)
+	}
+
+	expected := profile{AccessKey: testAccessKey, SecretKey: testToken, ProjectID: testProjectID, Zone: "pl-waw-1"}
+	if *work != expected {
+		t.Errorf("Expecting %+v, got %+v\n", expected, *work)
+	}
+
+	if _, err := parseScwConfig([]byte("access_key SCWXXX\n")); err == nil {
+		t.Error("Expecting a line without a key to be rejected")
+	}
+}
+
+func TestScwConfigProfile(t *testing.T) {
+	c, err := parseScwConfig([]byte(testScwConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		accessKey string
+		zone      string
+		region    string
+	}{
+		{"", testAccessKey, "pl-waw-1", "nl-ams"},
+		{"work", testAccessKey, "pl-waw-1", "nl-ams"},
+		{"legacy", "SCWDEFAULTXXXXXXXXXX", "nl-ams-1", "fr-par"},
+		{"default", "SCWDEFAULTXXXXXXXXXX", "nl-ams-1", "nl-ams"},
+	} {
+		p, err := c.profile(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.AccessKey != tc.accessKey || p.Zone != tc.zone || p.Region != tc.region || p.Organization != testOrganization {
+			t.Errorf("Profile '%s': unexpected %+v\n", tc.name, *p)
+		}
+	}
+
+	if _, err := c.profile("home"); err == nil {
+		t.Error("Expecting an unknown profile to be rejected")
+	}
+}
+
+func TestSetConfigFromProfile(t *testing.T) {
+	home, restore := withHome(t)
+	defer restore()
+
+	writeFile(t, filepath.Join(home, ".config", "scw", "config.yaml"), testScwConfig)
+	writeFile(t, filepath.Join(home, ".scwrc"), `{"organization": "`+testOrganization+`", "token": "`+testToken+`"}`)
+
+	for _, tc := range []struct {
+		flags    map[string]interface{}
+		expected profile
+	}{
+		// The active profile is read by default.
+		{map[string]interface{}{}, profile{
+			AccessKey: testAccessKey, SecretKey: testToken, ProjectID: testProjectID, Zone: "pl-waw-1",
+		}},
+		// Flags take precedence over the profile.
+		{map[string]interface{}{"scaleway-zone": "fr-par-1"}, profile{
+			AccessKey: testAccessKey, SecretKey: testToken, ProjectID: testProjectID, Zone: "fr-par-1",
+		}},
+		// A profile with an API key prevails over ~/.scwrc.
+		{map[string]interface{}{"scaleway-profile": "legacy"}, profile{
+			AccessKey: "SCWDEFAULTXXXXXXXXXX", SecretKey: "11111111-1111-4111-8111-111111111111",
+			ProjectID: testOrganization, Zone: "nl-ams-1",
+		}},
+		// A token given as a flag selects the legacy API.
+		{map[string]interface{}{"scaleway-token": "flag-token"}, profile{
+			Organization: testOrganization, Token: "flag-token", Region: "ams1",
+		}},
+	} {
+		td := NewDriver(testMachineName, testStorePath).(*Driver)
+		if err := td.SetConfigFromFlags(&commandstest.FakeFlagger{Data: tc.flags}); err != nil {
+			t.Fatal(err)
+		}
+
+		actual := profile{
+			Organization: td.Organization, Token: td.Token, Region: td.Region,
+			AccessKey: td.AccessKey, SecretKey: td.SecretKey, ProjectID: td.ProjectID, Zone: td.Zone,
+		}
+		if actual != tc.expected {
+			t.Errorf("%v: expecting %+v, got %+v\n", tc.flags, tc.expected, actual)
+		}
+	}
+}
+
+func TestSetConfigFromScwrc(t *testing.T) {
+	home, restore := withHome(t)
+	defer restore()
+
+	writeFile(t, filepath.Join(home, ".scwrc"), `{"organization": "`+testOrganization+`", "token": "`+testToken+`"}`)
+
+	td := NewDriver(testMachineName, testStorePath).(*Driver)
+	err := td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if td.Organization != testOrganization || td.Token != testToken || td.Region != defaultRegion {
+		t.Errorf("Expecting the credentials of ~/.scwrc, got '%s' '%s' in '%s'\n", td.Organization, td.Token, td.Region)
+	}
+
+	err = td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{"scaleway-profile": "work"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expecting a missing profile to be reported, got '%v'\n", err)
+	}
+
+	// A readable ~/.scwrc is rejected, which only leaves the credentials
+	// missing.
+	os.Chmod(filepath.Join(home, ".scwrc"), 0644)
+	td = NewDriver(testMachineName, testStorePath).(*Driver)
+	err = td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{},
+	})
+	if err == nil || !strings.Contains(err.Error(), "requires the --scaleway-organization option") {
+		t.Errorf("Expecting the credentials to be missing, got '%v'\n", err)
+	}
+}
+
+func TestSetConfigFromFlagsOnly(t *testing.T) {
+	home, restore := withHome(t)
+	defer restore()
+
+	// Neither a readable ~/.scwrc nor a malformed configuration file matter
+	// when the flags give the credentials.
+	writeFile(t, filepath.Join(home, ".scwrc"), `{"organization": "other", "token": "other"}`)
+	os.Chmod(filepath.Join(home, ".scwrc"), 0644)
+	writeFile(t, filepath.Join(home, ".config", "scw", "config.yaml"), "profiles\n")
+
+	for _, flags := range []map[string]interface{}{
+		{"scaleway-organization": testOrganization, "scaleway-token": testToken},
+		{"scaleway-access-key": testAccessKey, "scaleway-secret-key": testToken, "scaleway-project-id": testProjectID},
+	} {
+		td := NewDriver(testMachineName, testStorePath).(*Driver)
+		if err := td.SetConfigFromFlags(&commandstest.FakeFlagger{Data: flags}); err != nil {
+			t.Errorf("%v: expecting the flags to be enough, got %v\n", flags, err)
+		}
+
+		if td.Organization == "other" || td.Token == "other" {
+			t.Errorf("%v: expecting the files to be ignored, got '%s' '%s'\n", flags, td.Organization, td.Token)
+		}
+	}
+
+	// A profile given explicitly must be readable.
+	td := NewDriver(testMachineName, testStorePath).(*Driver)
+	err := td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{"scaleway-organization": testOrganization, "scaleway-token": testToken, "scaleway-profile": "work"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "config.yaml") {
+		t.Errorf("Expecting the malformed configuration file to be reported, got '%v'\n", err)
+	}
+}
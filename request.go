@@ -0,0 +1,153 @@
+package scaleway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+// rateLimitedError is an API error carrying the delay after which the API
+// accepts requests again.
+type rateLimitedError struct {
+	scw.ScalewayAPIError
+	retryAfter time.Duration
+}
+
+func (e rateLimitedError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// newHTTPClient returns the HTTP client of the API clients. Like with scw,
+// SCW_TLSVERIFY=0 skips the verification of the certificates of the API.
+func newHTTPClient() *http.Client {
+	client := &http.Client{Timeout: time.Minute}
+	if os.Getenv("SCW_TLSVERIFY") == "0" {
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	return client
+}
+
+// send sends a request to u with the secret token and decodes the response
+// into out, if not nil. body is sent as is when it is a []byte, and as JSON
+// otherwise. A response other than expected becomes a scw.ScalewayAPIError
+// which keeps its status code, or a rateLimitedError when the API tells when
+// to try again. Like with scw, SCW_VERBOSE_API logs the whole requests and
+// responses.
+func send(client *http.Client, token, method, u string, query url.Values, body, out interface{}, expected int) error {
+	var content io.Reader
+	contentType := "application/json"
+
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		content = bytes.NewReader(b)
+		contentType = "text/plain"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, content)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", contentType)
+
+	verbose := os.Getenv("SCW_VERBOSE_API") != ""
+	if verbose {
+		dump, _ := httputil.DumpRequestOut(req, true)
+		log.Debugf("%s", dump)
+	} else {
+		log.Debugf("[%s]: %s", method, u)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		log.Debugf("[Response]: [%d]\n%s", resp.StatusCode, data)
+	}
+
+	if resp.StatusCode != expected {
+		e := scw.ScalewayAPIError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, &e) != nil || e.APIMessage == "" {
+			e.APIMessage = strings.TrimSpace(string(data))
+		}
+		e.StatusCode = resp.StatusCode
+
+		limited := e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+		if wait := retryAfter(resp.Header); limited && wait > 0 {
+			return rateLimitedError{e, wait}
+		}
+		return e
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// retryAfter reads the delay requested by the Retry-After or X-RateLimit-Reset
+// headers of a response.
+func retryAfter(h http.Header) time.Duration {
+	if v := h.Get("Retry-After"); v != "" {
+		if s, err := strconv.Atoi(v); err == nil {
+			return time.Duration(s) * time.Second
+		}
+
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t)
+		}
+	}
+
+	// The reset time is either a number of seconds or a Unix timestamp.
+	if v := h.Get("X-RateLimit-Reset"); v != "" {
+		if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+			if s > 1e9 {
+				return time.Until(time.Unix(s, 0))
+			}
+			return time.Duration(s) * time.Second
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,82 @@
+package scaleway
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+// A failing API call is attempted up to retryAttempts times. The delay between
+// two attempts starts at retryMinDelay and doubles each time, up to
+// retryMaxDelay, with a random jitter so that concurrent drivers spread out.
+var (
+	retryAttempts = 5
+	retryMinDelay = time.Second
+	retryMaxDelay = 30 * time.Second
+)
+
+// rateLimited is implemented by errors which know when the API will accept
+// requests again, from the Retry-After or X-RateLimit-Reset headers.
+type rateLimited interface {
+	RetryAfter() time.Duration
+}
+
+// retry calls fn until it succeeds, fails with an error which is not
+// transient, or runs out of attempts. Calls which are not idempotent are only
+// retried when the API certainly did not process the request.
+func retry(what string, idempotent bool, fn func() error) error {
+	delay := retryMinDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !transient(err, idempotent) {
+			return err
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if e, ok := err.(rateLimited); ok && e.RetryAfter() > wait {
+			wait = e.RetryAfter()
+		}
+
+		log.Warnf("Cannot %s (%v), retrying in %s (%d/%d)...", what, err, wait.Round(time.Millisecond), attempt, retryAttempts-1)
+		if !pause(wait) {
+			return fmt.Errorf("interrupted while waiting to %s again: %v", what, err)
+		}
+
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// transient tells whether err may go away by sending the request again.
+func transient(err error, idempotent bool) bool {
+	if e, ok := err.(rateLimited); ok && e.RetryAfter() > 0 {
+		return true
+	}
+
+	switch e := err.(type) {
+	case scw.ScalewayAPIError:
+		switch {
+		case e.StatusCode == http.StatusTooManyRequests, e.StatusCode == http.StatusServiceUnavailable:
+			return true
+		case e.StatusCode >= http.StatusInternalServerError:
+			return idempotent
+		}
+		return false
+	case *url.Error:
+		// A failed dial means the request never reached the API.
+		if op, ok := e.Err.(*net.OpError); ok && op.Op == "dial" {
+			return true
+		}
+		return idempotent
+	}
+
+	return false
+}
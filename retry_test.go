@@ -0,0 +1,173 @@
+package scaleway
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"testing"
+	"time"
+
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+type rateLimitError time.Duration
+
+func (e rateLimitError) Error() string             { return "rate limited" }
+func (e rateLimitError) RetryAfter() time.Duration { return time.Duration(e) }
+
+func withRetryDelay(delay time.Duration) func() {
+	old := retryMinDelay
+	retryMinDelay = delay
+	return func() { retryMinDelay = old }
+}
+
+func TestTransient(t *testing.T) {
+	dial := &url.Error{Op: "Post", URL: "https://api", Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}
+	read := &url.Error{Op: "Get", URL: "https://api", Err: &net.OpError{Op: "read", Err: errors.New("reset")}}
+
+	for _, tc := range []struct {
+		err        error
+		idempotent bool
+		expected   bool
+	}{
+		{scw.ScalewayAPIError{StatusCode: http.StatusTooManyRequests}, false, true},
+		{scw.ScalewayAPIError{StatusCode: http.StatusServiceUnavailable}, false, true},
+		{scw.ScalewayAPIError{StatusCode: http.StatusBadGateway}, true, true},
+		{scw.ScalewayAPIError{StatusCode: http.StatusBadGateway}, false, false},
+		{scw.ScalewayAPIError{StatusCode: http.StatusBadRequest}, true, false},
+		{scw.ScalewayAPIError{StatusCode: http.StatusNotFound}, true, false},
+		{errors.New("cannot parse the image name"), true, false},
+		{dial, false, true},
+		{read, true, true},
+		{read, false, false},
+		{rateLimitError(time.Second), false, true},
+	} {
+		if actual := transient(tc.err, tc.idempotent); actual != tc.expected {
+			t.Errorf("Expecting transient(%v, %v) to be %v\n", tc.err, tc.idempotent, tc.expected)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer withRetryDelay(time.Millisecond)()
+
+	calls := 0
+	err := retry("test", true, func() error {
+		if calls++; calls < 3 {
+			return scw.ScalewayAPIError{StatusCode: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expecting success after 3 calls, got %v after %d\n", err, calls)
+	}
+
+	calls = 0
+	err = retry("test", true, func() error {
+		calls++
+		return scw.ScalewayAPIError{StatusCode: http.StatusInternalServerError}
+	})
+	if err == nil || calls != retryAttempts {
+		t.Errorf("Expecting failure after %d calls, got %v after %d\n", retryAttempts, err, calls)
+	}
+
+	calls = 0
+	err = retry("test", true, func() error {
+		calls++
+		return scw.ScalewayAPIError{StatusCode: http.StatusBadRequest}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Expecting a permanent error not to be retried, got %d calls\n", calls)
+	}
+}
+
+func TestRetryHonoursRetryAfter(t *testing.T) {
+	defer withRetryDelay(time.Millisecond)()
+
+	start, calls := time.Now(), 0
+	err := retry("test", false, func() error {
+		if calls++; calls == 1 {
+			return rateLimitError(100 * time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Expecting the retry to wait for the rate limit, waited %s\n", d)
+	}
+}
+
+func TestRetryInterrupt(t *testing.T) {
+	defer withRetryDelay(time.Minute)()
+
+	// Keep the interrupts from killing the test until retry catches one.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		p, _ := os.FindProcess(os.Getpid())
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				p.Signal(os.Interrupt)
+			}
+		}
+	}()
+
+	start := time.Now()
+	err := retry("test", true, func() error {
+		return scw.ScalewayAPIError{StatusCode: http.StatusTooManyRequests}
+	})
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("Expecting the retry to be interrupted, got '%v'\n", err)
+	}
+
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Expecting the interrupt to end the wait, took %s\n", d)
+	}
+}
+
+func TestCreateRetriesRateLimits(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	f.failNext("POST /servers", http.StatusTooManyRequests, http.StatusTooManyRequests)
+	f.failNext("GET /servers/{id}", http.StatusInternalServerError, http.StatusBadGateway)
+
+	td := f.newDriver()
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.count("POST /servers"); n != 3 {
+		t.Errorf("Expecting 3 server creation requests, got %d\n", n)
+	}
+}
+
+func TestCreateDoesNotRepeatCreations(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	f.failNext("POST /servers", http.StatusInternalServerError)
+
+	td := f.newDriver()
+	if err := td.Create(); err == nil {
+		t.Fatal("Expecting Create to fail")
+	}
+
+	if n := f.count("POST /servers"); n != 1 {
+		t.Errorf("Expecting a single server creation request, got %d\n", n)
+	}
+}
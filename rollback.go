@@ -0,0 +1,58 @@
+package scaleway
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// rollback records the resources allocated while creating a machine, so they
+// can be released in reverse order when a later step fails.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+// add registers the function releasing the named resource.
+func (r *rollback) add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name, undo})
+}
+
+// names returns the recorded resources in allocation order.
+func (r *rollback) names() []string {
+	names := make([]string, len(r.steps))
+	for i, s := range r.steps {
+		names[i] = s.name
+	}
+
+	return names
+}
+
+// run releases every recorded resource, the most recent first. It goes on
+// after a failure and returns an error naming the resources left behind.
+func (r *rollback) run() error {
+	var failed []string
+
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		s := r.steps[i]
+
+		log.Infof("Removing %s...", s.name)
+		if err := s.undo(); err != nil {
+			log.Errorf("Cannot remove %s: %v", s.name, err)
+			failed = append(failed, s.name)
+		}
+	}
+
+	r.steps = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot remove %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
+	"github.com/moul/anonuuid"
 	"github.com/scaleway/scaleway-cli/pkg/api"
 )
 
@@ -19,8 +24,32 @@ const (
 	defaultImage          = "ubuntu-xenial"
 	defaultCommercialType = "VC1S"
 	defaultRegion         = "ams1"
+	defaultZone           = "fr-par-1"
+	defaultKillAction     = "poweroff"
+	defaultHostKeyCheck   = "warn"
+	defaultCreateTimeout  = 600
+	defaultStopTimeout    = 300
+	defaultRemoveTimeout  = 300
+	defaultSwarmPort      = 3376
+	dockerPort            = 2376
+
+	// The swarm mode managers listen on swarmModePort, and the nodes talk to
+	// each other on swarmGossipPort and carry the overlay networks on
+	// swarmOverlayPort.
+	swarmModePort    = 2377
+	swarmGossipPort  = 7946
+	swarmOverlayPort = 4789
+
+	cloudInitKey    = "cloud-init"
+	maxUserdataSize = 64 * 1024
 )
 
+// regions lists the regions known to the API package.
+var regions = []string{"par1", "ams1"}
+
+// zones lists the zones of the Instance API.
+var zones = []string{"fr-par-1", "nl-ams-1", "pl-waw-1"}
+
 // Driver represents the Scaleway Docker Machine Driver and limits.
 type Driver struct {
 	*drivers.BaseDriver
@@ -30,12 +59,69 @@ type Driver struct {
 	ServerName     string
 	CommercialType string
 	Image          string
+	ImageID        string
+	Snapshot       string
+	Bootscript     string
+	LocalBoot      bool
 	Region         string
+	Zone           string
+	AccessKey      string
+	SecretKey      string
+	ProjectID      string
+	Profile        string
+	TokenSource    string
+	TokenCommand   string
 	IPID           string
+	IPCreated      bool
 	PersistentIP   bool
+	PrivateAddress bool
+	Gateway        string
+	GatewayAddress string
 	EnableIPv6     bool
 	Volumes        string
+	RootVolumeID   string
+	VolumeIDs      []string
 	Tags           string
+
+	HostKeyCheck        string
+	SSHHostFingerprints []string
+
+	SSHKey           string
+	RegisterSSHKey   bool
+	SSHKeyRegistered bool
+
+	Cache string
+
+	SecurityGroup        string
+	CreateSecurityGroup  bool
+	SecurityGroupID      string
+	SecurityGroupCreated bool
+
+	Userdata        string
+	UserdataEntries []string
+
+	KeepOnFailure    bool
+	KeepVolumes      bool
+	KeptVolumes      []string
+	SnapshotOnRemove bool
+
+	KillAction    string
+	KillTerminate bool
+	Terminated    bool
+
+	CreateTimeout int
+	StopTimeout   int
+	RemoveTimeout int
+
+	// clientFactory builds the API client of the driver. It defaults to
+	// newClient, and only the tests of the package replace it.
+	clientFactory func(d *Driver) (machineClient, error)
+
+	// gateway is the connection to --scaleway-gateway, opened on demand.
+	gateway *gateway
+
+	// cache is the name resolution cache of the API clients.
+	cache *api.ScalewayCache
 }
 
 // NewDriver returns a new Scaleway driver instance using the default and
@@ -45,6 +131,11 @@ func NewDriver(hostName, storePath string) drivers.Driver {
 		Image:          defaultImage,
 		CommercialType: defaultCommercialType,
 		Region:         defaultRegion,
+		KillAction:     defaultKillAction,
+		HostKeyCheck:   defaultHostKeyCheck,
+		CreateTimeout:  defaultCreateTimeout,
+		StopTimeout:    defaultStopTimeout,
+		RemoveTimeout:  defaultRemoveTimeout,
 		BaseDriver: &drivers.BaseDriver{
 			MachineName: hostName,
 			StorePath:   storePath,
@@ -100,11 +191,65 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Scaleway image name (e.g.: ubuntu-xenial)",
 			Value:  defaultImage,
 		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_IMAGE_ID",
+			Name:   "scaleway-image-id",
+			Usage:  "Scaleway image id, such as an image of the organization, instead of --scaleway-image",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_SNAPSHOT",
+			Name:   "scaleway-snapshot",
+			Usage:  "Scaleway snapshot name or id to restore as the root volume, instead of --scaleway-image",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_BOOTSCRIPT",
+			Name:   "scaleway-bootscript",
+			Usage:  "Scaleway bootscript name or id, the default bootscript of the image if unset",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_LOCAL_BOOT",
+			Name:   "scaleway-local-boot",
+			Usage:  "boot the server from its local volume instead of a bootscript, with the Instance API",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "SCALEWAY_REGION",
 			Name:   "scaleway-region",
-			Usage:  "Scaleway region name (e.g.: ams1,par1)",
-			Value:  defaultRegion,
+			Usage:  "Scaleway region name (e.g.: ams1,par1), ams1 by default",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_ZONE",
+			Name:   "scaleway-zone",
+			Usage:  "Scaleway Instance API zone (e.g.: fr-par-1)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_ACCESS_KEY",
+			Name:   "scaleway-access-key",
+			Usage:  "Scaleway API access key",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_SECRET_KEY",
+			Name:   "scaleway-secret-key",
+			Usage:  "Scaleway API secret key, selects the Instance API",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_PROJECT_ID",
+			Name:   "scaleway-project-id",
+			Usage:  "Scaleway project id",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_PROFILE",
+			Name:   "scaleway-profile",
+			Usage:  "Profile of the scw configuration file to read the credentials from",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_TOKEN_SOURCE",
+			Name:   "scaleway-token-source",
+			Usage:  "Where to get the token or secret key from: config (stored), env, profile or command",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_TOKEN_COMMAND",
+			Name:   "scaleway-token-command",
+			Usage:  "Command printing the token or secret key, for the command token source",
 		},
 		mcnflag.StringFlag{
 			EnvVar: "SCALEWAY_RESERVED_IP_ID",
@@ -116,6 +261,38 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "scaleway-persistent-ip",
 			Usage:  "enable IP persistent",
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_USE_PRIVATE_ADDRESS",
+			Name:   "scaleway-use-private-address",
+			Usage:  "Reach the server on its private IP, without a public one",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_GATEWAY",
+			Name:   "scaleway-gateway",
+			Usage:  "SSH gateway to reach the server through ([user@]host[:port] or server name)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_HOST_KEY_CHECK",
+			Name:   "scaleway-host-key-check",
+			Usage:  "on a mismatch with, or a lack of, published SSH host key fingerprints: strict fails, warn goes on",
+			Value:  defaultHostKeyCheck,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_SSH_KEY",
+			Name:   "scaleway-ssh-key",
+			Usage:  "existing RSA or ed25519 private key to use instead of a generated one",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_REGISTER_SSH_KEY",
+			Name:   "scaleway-register-ssh-key",
+			Usage:  "add the public SSH key to the account, and remove it along with the machine",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_CACHE",
+			Name:   "scaleway-cache",
+			Usage:  "where to cache resolved names: memory, or file in the machine directory",
+			Value:  "memory",
+		},
 		mcnflag.BoolFlag{
 			EnvVar: "SCALEWAY_ENABLE_IPv6",
 			Name:   "scaleway-enable-ipv6",
@@ -131,6 +308,73 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "scaleway-tags",
 			Usage:  "comma-separated list of tags to apply to the server",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_SECURITY_GROUP",
+			Name:   "scaleway-security-group",
+			Usage:  "name or id of an existing security group to attach",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_CREATE_SECURITY_GROUP",
+			Name:   "scaleway-create-security-group",
+			Usage:  "create a security group dropping the inbound traffic but on the SSH, Docker and Swarm ports",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_USERDATA",
+			Name:   "scaleway-userdata",
+			Usage:  "cloud-init user data, as an existing file, a file:// or @ prefixed path, or inline",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "scaleway-userdata-entry",
+			Usage: "user data entry to set on the server (e.g.: key=value)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_KEEP_ON_FAILURE",
+			Name:   "scaleway-keep-on-failure",
+			Usage:  "keep the resources of a failed creation for debugging",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_KEEP_VOLUMES",
+			Name:   "scaleway-keep-volumes",
+			Usage:  "keep the volumes when removing the server",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "scaleway-keep-volume",
+			Usage: "volume to keep when removing the server, by index (0 for the root volume) or id",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_SNAPSHOT_ON_REMOVE",
+			Name:   "scaleway-snapshot-on-remove",
+			Usage:  "snapshot the volumes before removing the server",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "SCALEWAY_KILL_ACTION",
+			Name:   "scaleway-kill-action",
+			Usage:  "server action used by kill: poweroff or stop_in_place",
+			Value:  defaultKillAction,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "SCALEWAY_KILL_TERMINATE",
+			Name:   "scaleway-kill-terminate",
+			Usage:  "let kill terminate the server, destroying its volumes, when it cannot be stopped",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "SCALEWAY_CREATE_TIMEOUT",
+			Name:   "scaleway-create-timeout",
+			Usage:  "seconds to wait for a created server to be ready, 0 to wait forever",
+			Value:  defaultCreateTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "SCALEWAY_STOP_TIMEOUT",
+			Name:   "scaleway-stop-timeout",
+			Usage:  "seconds to wait for the server to stop, 0 to wait forever",
+			Value:  defaultStopTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "SCALEWAY_REMOVE_TIMEOUT",
+			Name:   "scaleway-remove-timeout",
+			Usage:  "seconds to wait for the server and its volumes to be removed, 0 to wait forever",
+			Value:  defaultRemoveTimeout,
+		},
 	}
 }
 
@@ -144,21 +388,109 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.ServerName = flags.String("scaleway-server-name")
 	d.CommercialType = flags.String("scaleway-commercial-type")
 	d.Image = flags.String("scaleway-image")
+	d.ImageID = flags.String("scaleway-image-id")
+	d.Snapshot = flags.String("scaleway-snapshot")
+	d.Bootscript = flags.String("scaleway-bootscript")
+	d.LocalBoot = flags.Bool("scaleway-local-boot")
 	d.Region = flags.String("scaleway-region")
+	d.Zone = flags.String("scaleway-zone")
+	d.AccessKey = flags.String("scaleway-access-key")
+	d.SecretKey = flags.String("scaleway-secret-key")
+	d.ProjectID = flags.String("scaleway-project-id")
+	d.Profile = flags.String("scaleway-profile")
+	d.TokenSource = flags.String("scaleway-token-source")
+	d.TokenCommand = flags.String("scaleway-token-command")
 	d.IPID = flags.String("scaleway-reserved-ip-id")
 	d.PersistentIP = flags.Bool("scaleway-persistent-ip")
+	d.PrivateAddress = flags.Bool("scaleway-use-private-address")
+	d.Gateway = flags.String("scaleway-gateway")
+	d.HostKeyCheck = flags.String("scaleway-host-key-check")
+	d.SSHKey = flags.String("scaleway-ssh-key")
+	d.RegisterSSHKey = flags.Bool("scaleway-register-ssh-key")
+	d.Cache = flags.String("scaleway-cache")
 	d.EnableIPv6 = flags.Bool("scaleway-enable-ipv6")
 	d.Volumes = flags.String("scaleway-volumes")
 	d.Tags = flags.String("scaleway-tags")
+	d.SecurityGroup = flags.String("scaleway-security-group")
+	d.CreateSecurityGroup = flags.Bool("scaleway-create-security-group")
+	d.Userdata = flags.String("scaleway-userdata")
+	d.UserdataEntries = flags.StringSlice("scaleway-userdata-entry")
+	d.KeepOnFailure = flags.Bool("scaleway-keep-on-failure")
+	d.KeepVolumes = flags.Bool("scaleway-keep-volumes")
+	d.KeptVolumes = flags.StringSlice("scaleway-keep-volume")
+	d.SnapshotOnRemove = flags.Bool("scaleway-snapshot-on-remove")
+	d.KillAction = flags.String("scaleway-kill-action")
+	d.KillTerminate = flags.Bool("scaleway-kill-terminate")
+	d.CreateTimeout = flags.Int("scaleway-create-timeout")
+	d.StopTimeout = flags.Int("scaleway-stop-timeout")
+	d.RemoveTimeout = flags.Int("scaleway-remove-timeout")
 
 	d.SetSwarmConfigFromFlags(flags)
 
-	if d.Organization == "" {
-		return errors.New("scaleway driver requires the --scaleway-organization option")
+	if err := d.checkTokenSource(); err != nil {
+		return err
+	}
+
+	if err := d.loadProfile(); err != nil {
+		return err
+	}
+
+	if err := d.checkCredentialFlags(); err != nil {
+		return err
+	}
+
+	if d.PrivateAddress && (d.IPID != "" || d.PersistentIP) {
+		return errors.New("--scaleway-use-private-address excludes --scaleway-reserved-ip-id and --scaleway-persistent-ip")
+	}
+
+	if d.SecurityGroup != "" && d.CreateSecurityGroup {
+		return errors.New("--scaleway-security-group and --scaleway-create-security-group are mutually exclusive")
+	}
+
+	if d.ImageID != "" && anonuuid.IsUUID(d.ImageID) != nil {
+		return fmt.Errorf("invalid --scaleway-image-id %q, expecting an image id", d.ImageID)
+	}
+
+	if d.Snapshot != "" {
+		if d.ImageID != "" {
+			return errors.New("--scaleway-snapshot and --scaleway-image-id are mutually exclusive")
+		}
+	}
+
+	if d.LocalBoot {
+		if d.Bootscript != "" {
+			return errors.New("--scaleway-bootscript and --scaleway-local-boot are mutually exclusive")
+		}
+
+		if !d.useInstanceAPI() {
+			return errors.New("--scaleway-local-boot requires the Instance API")
+		}
+	}
+
+	for _, e := range d.UserdataEntries {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("invalid --scaleway-userdata-entry %q, expecting key=value", e)
+		}
+	}
+
+	if d.KillAction == "" {
+		d.KillAction = defaultKillAction
+	} else if d.KillAction != "poweroff" && d.KillAction != "stop_in_place" {
+		return fmt.Errorf("invalid --scaleway-kill-action %q, expecting poweroff or stop_in_place", d.KillAction)
+	}
+
+	if d.HostKeyCheck == "" {
+		d.HostKeyCheck = defaultHostKeyCheck
+	} else if d.HostKeyCheck != "strict" && d.HostKeyCheck != "warn" {
+		return fmt.Errorf("invalid --scaleway-host-key-check %q, expecting strict or warn", d.HostKeyCheck)
+	}
+
+	if d.Cache != "" && !contains(cacheModes, d.Cache) {
+		return fmt.Errorf("invalid --scaleway-cache %q, expecting memory or file", d.Cache)
 	}
 
-	if d.Token == "" {
-		return errors.New("scaleway driver requires the --scaleway-token option")
+	if d.CreateTimeout < 0 || d.StopTimeout < 0 || d.RemoveTimeout < 0 {
+		return errors.New("the --scaleway-*-timeout options must not be negative")
 	}
 
 	return nil
@@ -175,77 +507,344 @@ func (d *Driver) GetURL() (string, error) {
 		return "", err
 	}
 
-	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, strconv.Itoa(dockerPort))), nil
+}
+
+// GetIP returns the public IP address of the server, or its private one with
+// --scaleway-use-private-address. The address is refreshed from the API so
+// that the stored state follows the server.
+func (d *Driver) GetIP() (string, error) {
+	if d.ServerID == "" {
+		return d.BaseDriver.GetIP()
+	}
+
+	c, err := d.client()
+	if err != nil {
+		return "", err
+	}
+
+	server, err := c.getServer()
+	if err != nil {
+		return "", err
+	}
+
+	addr := d.serverAddress(server)
+	if addr == "" {
+		return "", fmt.Errorf("server has no %s IP address", d.addressKind())
+	}
+
+	d.IPAddress = addr
+	return d.IPAddress, nil
 }
 
-// GetSSHHostname returns an IP address or hostname for the instance.
+// GetSSHHostname returns an IP address or hostname for the instance. With
+// --scaleway-gateway, it is the local end of a tunnel through the gateway.
 func (d *Driver) GetSSHHostname() (string, error) {
-	return d.GetIP()
+	if d.Gateway == "" || d.ServerID == "" {
+		return d.GetIP()
+	}
+
+	addr, err := d.sshTunnel()
+	if err != nil {
+		return "", err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	return host, err
+}
+
+// GetSSHPort returns the SSH port of the server, or the local port of the
+// tunnel through --scaleway-gateway.
+func (d *Driver) GetSSHPort() (int, error) {
+	if d.Gateway == "" || d.ServerID == "" {
+		return d.BaseDriver.GetSSHPort()
+	}
+
+	addr, err := d.sshTunnel()
+	if err != nil {
+		return 0, err
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(port)
 }
 
 // PreCreateCheck allows for pre-create operations to make sure a driver is
 // ready for creation.
 func (d *Driver) PreCreateCheck() error {
-	c, err := newClient(d)
+	if _, err := d.userdata(); err != nil {
+		return err
+	}
+
+	if d.SSHKey != "" {
+		if _, _, err := readSSHKey(d.SSHKey); err != nil {
+			return err
+		}
+	}
+
+	if d.useInstanceAPI() {
+		if !contains(zones, d.Zone) {
+			return fmt.Errorf("unknown zone %s%s", d.Zone, suggest(d.Zone, zones))
+		}
+	} else if !contains(regions, d.Region) {
+		return fmt.Errorf("unknown region %s%s", d.Region, suggest(d.Region, regions))
+	}
+
+	c, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if err = c.checkCredentials(); err != nil {
+		return err
+	}
+
+	if err = d.resolveGateway(c); err != nil {
+		return err
+	}
+
+	offer, err := c.getOffer(serverCommercialType(d.CommercialType))
 	if err != nil {
 		return err
 	}
 
-	return c.checkCredentials()
+	switch {
+	case d.Snapshot != "":
+		_, err = c.resolveSnapshot(d.Snapshot, offer, d.Volumes)
+	case !isVolumeSize(d.imageName()):
+		_, err = c.resolveImage(d.imageName(), targetArch(offer))
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.Bootscript != "" {
+		if _, err = c.resolveBootscript(d.Bootscript, targetArch(offer)); err != nil {
+			return err
+		}
+	}
+
+	return c.checkQuotas(d.plannedResources(offer))
 }
 
 // Create creates a new server using the Scaleway API and the helper methods of
-// the *Driver instance.
+// the *Driver instance. The resources allocated before a failing step are
+// released, unless --scaleway-keep-on-failure is set.
 func (d *Driver) Create() error {
-	c, err := newClient(d)
+	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Creating SSH key for server...")
-	pub, err := d.createSSHKey()
+	userdata, err := d.userdata()
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Reserving IP...")
-	ip, err := c.reserveIP()
+	var pub string
+	if d.SSHKey != "" {
+		log.Infof("Copying SSH key %s...", d.SSHKey)
+		pub, err = d.copySSHKey()
+	} else {
+		log.Infof("Creating SSH key for server...")
+		pub, err = d.createSSHKey()
+	}
 	if err != nil {
 		return err
 	}
 
+	var undo rollback
+	if err = d.create(c, &undo, pub, userdata); err != nil {
+		if len(undo.steps) == 0 {
+			return err
+		}
+
+		if d.KeepOnFailure {
+			log.Warnf("Keeping %s for debugging", strings.Join(undo.names(), ", "))
+			return err
+		}
+
+		log.Warnf("Create failed, removing the allocated resources...")
+		if rerr := undo.run(); rerr != nil {
+			log.Errorf("%v, remove them manually", rerr)
+		}
+
+		return err
+	}
+
+	if err = d.saveCache(); err != nil {
+		log.Warnf("Cannot save the cache: %v", err)
+	}
+
+	return nil
+}
+
+// create allocates the server and its resources, registering in undo how to
+// release each of them.
+func (d *Driver) create(c machineClient, undo *rollback, pub string, userdata map[string][]byte) error {
+	var err error
+
+	if d.SecurityGroup != "" {
+		log.Infof("Resolving security group...")
+		if d.SecurityGroupID, err = c.securityGroupID(d.SecurityGroup); err != nil {
+			return err
+		}
+	}
+
+	if d.CreateSecurityGroup {
+		log.Infof("Creating security group...")
+		d.SecurityGroupID, err = c.createSecurityGroup(d.securityGroupName(), d.securityGroupPorts())
+		d.SecurityGroupCreated = d.SecurityGroupID != ""
+		if d.SecurityGroupCreated {
+			id := d.SecurityGroupID
+			undo.add("security group "+id, func() error {
+				if err := c.deleteSecurityGroup(id); err != nil {
+					return err
+				}
+				d.SecurityGroupID, d.SecurityGroupCreated = "", false
+				return nil
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Servers fetch the keys of the account when they boot.
+	if d.RegisterSSHKey {
+		log.Infof("Registering SSH key on the account...")
+		owned, err := c.registerSSHKey(pub)
+		if err != nil {
+			return err
+		}
+		if owned {
+			d.SSHKeyRegistered = true
+			undo.add("SSH key", func() error {
+				if err := c.deregisterSSHKey(pub); err != nil {
+					return err
+				}
+				d.SSHKeyRegistered = false
+				return nil
+			})
+		}
+	}
+
+	if !d.PrivateAddress {
+		log.Infof("Reserving IP...")
+		d.IPCreated = d.IPID == ""
+		ip, err := c.reserveIP()
+		if err != nil {
+			return err
+		}
+		d.IPID = ip.IP.ID
+		d.IPAddress = ip.IP.Address
+
+		if d.IPCreated {
+			undo.add("IP "+ip.IP.Address, func() error {
+				if err := c.deleteIP(ip.IP.ID); err != nil {
+					return err
+				}
+				d.IPID, d.IPAddress, d.IPCreated = "", "", false
+				return nil
+			})
+		}
+	}
+
+	// Without a reserved IP and a dynamic one, the server has no public IP.
 	serverConfig := &api.ConfigCreateServer{
 		Name:              d.ServerName,
 		CommercialType:    d.CommercialType,
-		ImageName:         d.Image,
-		IP:                ip.IP.Address,
+		ImageName:         d.imageName(),
+		Bootscript:        d.Bootscript,
+		IP:                d.IPID,
+		DynamicIPRequired: false,
 		EnableIPV6:        d.EnableIPv6,
 		AdditionalVolumes: d.Volumes,
 		Env:               d.authorizedKey(pub) + " " + c.tags(),
 	}
 
 	log.Infof("Creating server...")
-	d.ServerID, err = c.createServer(serverConfig)
+	d.ServerID, err = c.createServer(serverConfig, func(id string) {
+		d.VolumeIDs = append(d.VolumeIDs, id)
+		undo.add("volume "+id, func() error {
+			return c.deleteVolume(id)
+		})
+	})
 	if err != nil {
 		return err
 	}
 
+	undo.add("server "+d.ServerID, func() error {
+		if err := c.deleteServerAndVolumes(); err != nil {
+			return err
+		}
+		d.ServerID = ""
+		return nil
+	})
+
+	server, err := c.getServer()
+	if err != nil {
+		return err
+	}
+	d.RootVolumeID = server.Volumes["0"].Identifier
+
+	if d.LocalBoot {
+		log.Infof("Setting local boot...")
+		if err = c.setLocalBoot(); err != nil {
+			return err
+		}
+	}
+
+	if d.SecurityGroupID != "" {
+		log.Infof("Attaching security group...")
+		if err = c.setSecurityGroup(d.SecurityGroupID); err != nil {
+			return err
+		}
+	}
+
+	if len(userdata) > 0 {
+		log.Infof("Writing user data...")
+		keys, err := c.setUserdata(userdata)
+		if err != nil {
+			return err
+		}
+		log.Infof("Wrote user data keys: %s", strings.Join(keys, ", "))
+	}
+
 	log.Infof("Starting server...")
 	if err = c.startServer(); err != nil {
 		return err
 	}
 
+	if err = d.resolveGateway(c); err != nil {
+		return err
+	}
+
 	log.Info("Waiting for server to be ready...")
-	return c.waitForServerReady()
+	if err = c.waitForServerReady(); err != nil {
+		return err
+	}
+
+	log.Info("Verifying the SSH host key...")
+	return d.verifyHostKey(c)
 }
 
 // GetState returns the state of the server.
 func (d *Driver) GetState() (state.State, error) {
-	c, err := newClient(d)
+	c, err := d.client()
 	if err != nil {
 		return state.Error, err
 	}
 
+	// A server terminated by Kill is gone, which is as stopped as it gets.
+	if d.Terminated {
+		return state.Stopped, nil
+	}
+
 	server, err := c.getServer()
 	if err != nil {
 		return state.Error, err
@@ -258,7 +857,7 @@ func (d *Driver) GetState() (state.State, error) {
 		return state.Running, nil
 	case "stopping":
 		return state.Stopping, nil
-	case "stopped":
+	case "stopped", "stopped in place":
 		return state.Stopped, nil
 	}
 
@@ -268,18 +867,22 @@ func (d *Driver) GetState() (state.State, error) {
 // Start starts the server using the API wrapper. If the server is already running,
 // the wrapper is not called.
 func (d *Driver) Start() error {
-	c, err := newClient(d)
+	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	return c.startServer()
+	if err = c.startServer(); err != nil {
+		return err
+	}
+
+	return d.refreshAddress(c)
 }
 
 // Stop stops the server using the API wrapper. If the server is already stopping,
 // the wrapper is not called.
 func (d *Driver) Stop() error {
-	c, err := newClient(d)
+	c, err := d.client()
 	if err != nil {
 		return err
 	}
@@ -289,27 +892,174 @@ func (d *Driver) Stop() error {
 
 // Restart restarts the server using the API wrapper.
 func (d *Driver) Restart() error {
-	c, err := newClient(d)
+	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	return c.rebootServer()
+	if err = c.rebootServer(); err != nil {
+		return err
+	}
+
+	return d.refreshAddress(c)
+}
+
+// refreshAddress waits for a booting server to be ready with
+// --scaleway-use-private-address, since its private IP changes on every boot.
+// waitForServerReady stores the new address.
+func (d *Driver) refreshAddress(c machineClient) error {
+	if !d.PrivateAddress {
+		return nil
+	}
+
+	log.Info("Waiting for the private IP of the server...")
+	return c.waitForServerReady()
+}
+
+// serverAddress returns the address the driver reaches server on.
+func (d *Driver) serverAddress(server *api.ScalewayServer) string {
+	if d.PrivateAddress {
+		return server.PrivateIP
+	}
+
+	return server.PublicAddress.IP
+}
+
+func (d *Driver) addressKind() string {
+	if d.PrivateAddress {
+		return "private"
+	}
+
+	return "public"
 }
 
-// Kill kills the server using the API wrapper.
+// Kill stops the server at once with --scaleway-kill-action. When that fails
+// and --scaleway-kill-terminate is set, the server is terminated instead.
 func (d *Driver) Kill() error {
-	return errors.New("kill is not supported for scaleway driver")
+	c, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	st, err := d.GetState()
+	if err != nil {
+		return err
+	}
+
+	if st == state.Stopped {
+		return nil
+	}
+
+	// Machines created before --scaleway-kill-action have none stored.
+	action := d.KillAction
+	if action == "" {
+		action = defaultKillAction
+	}
+
+	if err = c.killServer(action); err != nil {
+		if !d.KillTerminate {
+			return err
+		}
+
+		log.Warnf("Cannot %s the server (%v), terminating it...", action, err)
+		if err = c.terminateServer(); err != nil {
+			return err
+		}
+
+		if err = c.waitForServerRemoval(); err != nil {
+			return err
+		}
+
+		d.Terminated = true
+		return nil
+	}
+
+	return waitFor("the server to stop", d.timeout(d.StopTimeout), func() (bool, error) {
+		st, err := d.GetState()
+		return st == state.Stopped, err
+	})
 }
 
-// Remove deletes the server and optionally the resources.
+// Remove deletes the server and the resources created with it. Resources which
+// are already gone count as removed, and every step is attempted even when a
+// previous one failed, so that Remove can be run again to finish the job.
 func (d *Driver) Remove() error {
-	c, err := newClient(d)
+	c, err := d.client()
 	if err != nil {
 		return err
 	}
 
-	return c.removeServer()
+	var failed []string
+	fail := func(resource string, err error) {
+		failed = append(failed, fmt.Sprintf("%s: %v", resource, err))
+	}
+
+	// Volumes can only be deleted once detached, which is known to happen
+	// when the server is gone.
+	detached := true
+
+	server, err := c.findServer()
+
+	// Nothing is removed unless the volumes could be snapshotted.
+	if d.SnapshotOnRemove && (server != nil || err != nil) {
+		if err == nil {
+			err = d.snapshotVolumes(c, server)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot snapshot the volumes, keeping the machine: %v", err)
+		}
+	}
+
+	if err != nil {
+		fail("server "+d.ServerID, err)
+		detached = false
+	}
+
+	remove, keep := d.ownedVolumes(server)
+
+	if server != nil {
+		if err = c.removeServer(server, len(keep) > 0); err != nil {
+			fail("server "+d.ServerID, err)
+			detached = false
+		}
+	}
+
+	if d.IPCreated && !d.PersistentIP && d.IPID != "" {
+		log.Infof("Releasing IP %s...", d.IPAddress)
+		if err = c.deleteIP(d.IPID); err != nil {
+			fail("IP "+d.IPAddress, err)
+		}
+	}
+
+	for _, id := range remove {
+		if err = c.removeVolume(id, detached); err != nil {
+			fail("volume "+id, err)
+		}
+	}
+
+	if d.SecurityGroupCreated && d.SecurityGroupID != "" {
+		log.Infof("Deleting security group...")
+		if err = c.deleteSecurityGroup(d.SecurityGroupID); err != nil {
+			fail("security group "+d.SecurityGroupID, err)
+		}
+	}
+
+	if d.SSHKeyRegistered {
+		log.Infof("Removing the SSH key from the account...")
+		pub, err := ioutil.ReadFile(d.publicSSHKeyPath())
+		if err == nil {
+			err = c.deregisterSSHKey(string(pub))
+		}
+		if err != nil {
+			fail("SSH key", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot remove %s", strings.Join(failed, "; "))
+	}
+
+	return nil
 }
 
 func (d *Driver) authorizedKey(pub string) string {
@@ -330,6 +1080,273 @@ func (d *Driver) createSSHKey() (string, error) {
 	return string(pub), nil
 }
 
+// userdata returns the user data to write on the server, indexed by key. The
+// --scaleway-userdata value is stored under the cloud-init key. It is read
+// from disk when it names an existing file, or when a file:// or @ prefix
+// marks it as a path, which must then name a file; other values are inline
+// user data.
+func (d *Driver) userdata() (map[string][]byte, error) {
+	data := make(map[string][]byte)
+
+	if d.Userdata != "" {
+		value := []byte(d.Userdata)
+		path, explicit := userdataPath(d.Userdata)
+		fi, err := os.Stat(path)
+		switch {
+		case err == nil && fi.Mode().IsRegular():
+			if value, err = ioutil.ReadFile(path); err != nil {
+				return nil, err
+			}
+		case err == nil:
+			return nil, fmt.Errorf("--scaleway-userdata %s is not a regular file", path)
+		case explicit:
+			return nil, fmt.Errorf("cannot read --scaleway-userdata: %v", err)
+		}
+		data[cloudInitKey] = value
+	}
+
+	for _, e := range d.UserdataEntries {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid user data entry %q, expecting key=value", e)
+		}
+		if _, ok := data[kv[0]]; ok {
+			return nil, fmt.Errorf("user data key %s is set more than once", kv[0])
+		}
+		data[kv[0]] = []byte(kv[1])
+	}
+
+	for key, value := range data {
+		if len(value) > maxUserdataSize {
+			return nil, fmt.Errorf("user data %s is %d bytes, the limit is %d bytes", key, len(value), maxUserdataSize)
+		}
+	}
+
+	return data, nil
+}
+
+// userdataPath returns the file a --scaleway-userdata value names, without its
+// file:// or @ prefix, and whether it had one.
+func userdataPath(value string) (string, bool) {
+	for _, prefix := range []string{"file://", "@"} {
+		if strings.HasPrefix(value, prefix) {
+			return strings.TrimPrefix(value, prefix), true
+		}
+	}
+
+	return value, false
+}
+
+func (d *Driver) securityGroupName() string {
+	return "docker-machine-" + d.MachineName
+}
+
+// securityGroupPorts returns the ports that a created security group opens,
+// the other inbound traffic being dropped: SSH and the Docker engine and, on
+// the nodes of a swarm, the swarm mode ports and, on swarm masters, the swarm
+// manager. --swarm-host has a default, so swarm nodes are told by
+// --swarm-master and --swarm-discovery.
+func (d *Driver) securityGroupPorts() []groupPort {
+	ssh := d.SSHPort
+	if ssh == 0 {
+		ssh = drivers.DefaultSSHPort
+	}
+
+	ports := []groupPort{
+		{"TCP", ssh},
+		{"TCP", dockerPort},
+	}
+
+	if d.SwarmMaster || d.SwarmDiscovery != "" {
+		ports = append(ports,
+			groupPort{"TCP", swarmModePort},
+			groupPort{"TCP", swarmGossipPort},
+			groupPort{"UDP", swarmGossipPort},
+			groupPort{"UDP", swarmOverlayPort},
+		)
+	}
+
+	if d.SwarmMaster {
+		port := defaultSwarmPort
+		if u, err := url.Parse(d.SwarmHost); err == nil {
+			if p, err := strconv.Atoi(u.Port()); err == nil {
+				port = p
+			}
+		}
+		ports = append(ports, groupPort{"TCP", port})
+	}
+
+	return ports
+}
+
+// client returns an API client for the driver from its clientFactory.
+func (d *Driver) client() (machineClient, error) {
+	if err := d.resolveToken(); err != nil {
+		return nil, err
+	}
+
+	if d.clientFactory != nil {
+		return d.clientFactory(d)
+	}
+
+	return newClient(d)
+}
+
+// checkCredentialFlags checks that the options select exactly one API: the
+// legacy API with an organization and a token, or the Instance API with an
+// access key, a secret key and a project.
+func (d *Driver) checkCredentialFlags() error {
+	if !d.useInstanceAPI() {
+		if d.Organization == "" {
+			return errors.New("scaleway driver requires the --scaleway-organization option")
+		}
+
+		if d.Token == "" {
+			return errors.New("scaleway driver requires the --scaleway-token option or the --scaleway-secret-key option")
+		}
+
+		if d.AccessKey != "" {
+			return errors.New("--scaleway-access-key requires the --scaleway-secret-key option")
+		}
+
+		if d.Region == "" {
+			d.Region = defaultRegion
+		}
+
+		return nil
+	}
+
+	if d.Token != "" {
+		return errors.New("--scaleway-token and --scaleway-secret-key are mutually exclusive")
+	}
+
+	if d.SecretKey == "" {
+		return errors.New("--scaleway-access-key requires the --scaleway-secret-key option")
+	}
+
+	if d.AccessKey == "" || d.ProjectID == "" {
+		return errors.New("--scaleway-secret-key requires the --scaleway-access-key and --scaleway-project-id options")
+	}
+
+	if d.Zone == "" {
+		d.Zone = defaultZone
+	}
+
+	return nil
+}
+
+// useInstanceAPI tells whether the driver talks to the zoned Instance API
+// rather than the legacy one. Before a runtime secret is resolved, the access
+// key tells.
+func (d *Driver) useInstanceAPI() bool {
+	return d.SecretKey != "" || (d.Token == "" && d.AccessKey != "")
+}
+
+// checkTokenSource checks the token source options, and resolves the API
+// secret of the command source so that the command is known to work.
+func (d *Driver) checkTokenSource() error {
+	if d.TokenSource == "" && d.TokenCommand != "" {
+		d.TokenSource = "command"
+	}
+
+	if d.TokenSource != "" && !contains(tokenSources, d.TokenSource) {
+		return fmt.Errorf("invalid --scaleway-token-source %q%s", d.TokenSource, suggest(d.TokenSource, tokenSources))
+	}
+
+	if (d.TokenSource == "command") != (d.TokenCommand != "") {
+		return errors.New("--scaleway-token-source command and --scaleway-token-command go together")
+	}
+
+	if d.TokenSource == "command" {
+		return d.resolveToken()
+	}
+
+	return nil
+}
+
+// imageName returns what the server is created from: the --scaleway-snapshot as
+// snapshot:name, the --scaleway-image-id or the --scaleway-image.
+func (d *Driver) imageName() string {
+	switch {
+	case d.Snapshot != "":
+		return "snapshot:" + d.Snapshot
+	case d.ImageID != "":
+		return d.ImageID
+	}
+
+	return d.Image
+}
+
+// location returns the zone or the region where the server lives.
+func (d *Driver) location() string {
+	if d.useInstanceAPI() {
+		return d.Zone
+	}
+
+	return d.Region
+}
+
+// plannedResources counts the servers, IPs and volumes that Create allocates:
+// the server, its IP unless a reserved one is given or the private address is
+// used, its root volume and the --scaleway-volumes, or without them the
+// volumes filling the minimum size of the offer.
+func (d *Driver) plannedResources(offer *api.ProductServer) map[string]int {
+	ips := 1
+	if d.IPID != "" || d.PrivateAddress {
+		ips = 0
+	}
+
+	volumes := d.Volumes
+	if volumes == "" && offer.VolumesConstraint.MinSize > 0 && d.Snapshot == "" {
+		volumes = api.VolumesFromSize(offer.VolumesConstraint.MinSize)
+	}
+
+	return map[string]int{
+		"servers": 1,
+		"ips":     ips,
+		"volumes": 1 + len(strings.Fields(volumes)),
+	}
+}
+
+// ownedVolumes splits the volumes created along with the server, i.e. its root
+// volume and those from --scaleway-volumes, into the ones to delete with it
+// and the ones to keep. server may be nil when it is already gone.
+func (d *Driver) ownedVolumes(server *api.ScalewayServer) (remove, keep []string) {
+	root := d.RootVolumeID
+	if root == "" && server != nil {
+		root = server.Volumes["0"].Identifier
+	}
+
+	for i, id := range append([]string{root}, d.VolumeIDs...) {
+		if id == "" {
+			continue
+		}
+
+		if d.KeepVolumes || contains(d.KeptVolumes, strconv.Itoa(i)) || contains(d.KeptVolumes, id) {
+			keep = append(keep, id)
+		} else {
+			remove = append(remove, id)
+		}
+	}
+
+	return remove, keep
+}
+
+// timeout converts a timeout option given in seconds.
+func (d *Driver) timeout(seconds int) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (d *Driver) publicSSHKeyPath() string {
 	return d.GetSSHKeyPath() + ".pub"
 }
@@ -1,12 +1,20 @@
 package scaleway
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/docker/machine/commands/commandstest"
+	"github.com/docker/machine/libmachine/state"
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
 )
 
 const (
@@ -130,3 +138,1386 @@ func TestScalewayConfigs(t *testing.T) {
 		t.Errorf("Expecting '%s', got '%s'\n", testTags, actualTags)
 	}
 }
+
+func TestCreate(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.ServerName = testServerName
+	td.Tags = testTags
+
+	if err := td.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := f.server(td.ServerID)
+	if server == nil {
+		t.Fatalf("Expecting server '%s' to exist\n", td.ServerID)
+	}
+
+	if server.State != "running" {
+		t.Errorf("Expecting 'running', got '%s'\n", server.State)
+	}
+
+	if server.Name != testServerName {
+		t.Errorf("Expecting '%s', got '%s'\n", testServerName, server.Name)
+	}
+
+	if server.Image.Identifier != testImageID {
+		t.Errorf("Expecting '%s', got '%s'\n", testImageID, server.Image.Identifier)
+	}
+
+	if server.PublicAddress.IP == "" {
+		t.Error("Expecting the server to have a public IP")
+	}
+
+	if td.IPID != server.PublicAddress.Identifier || !td.IPCreated {
+		t.Errorf("Expecting '%s' to be stored as created, got '%s'\n", server.PublicAddress.Identifier, td.IPID)
+	}
+
+	if td.IPAddress != server.PublicAddress.IP {
+		t.Errorf("Expecting '%s', got '%s'\n", server.PublicAddress.IP, td.IPAddress)
+	}
+
+	tags := strings.Join(server.Tags, " ")
+	if !strings.Contains(tags, "AUTHORIZED_KEY=ssh-rsa_") {
+		t.Errorf("Expecting an AUTHORIZED_KEY tag, got '%s'\n", tags)
+	}
+
+	if !strings.Contains(tags, "foo bar baz") {
+		t.Errorf("Expecting 'foo bar baz' tags, got '%s'\n", tags)
+	}
+}
+
+func TestCreateWithReservedIP(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	ip := f.addIP()
+
+	td := f.newDriver()
+	td.IPID = ip.ID
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.count("POST /ips"); n != 0 {
+		t.Errorf("Expecting no new IP, got %d\n", n)
+	}
+
+	server := f.server(td.ServerID)
+	if server.PublicAddress.Identifier != ip.ID {
+		t.Errorf("Expecting '%s', got '%s'\n", ip.ID, server.PublicAddress.Identifier)
+	}
+
+	if td.IPCreated {
+		t.Error("Expecting a reserved IP not to be owned by the driver")
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.ip(ip.ID) == nil {
+		t.Error("Expecting a reserved IP to be kept")
+	}
+}
+
+func TestRemoveKeepsPersistentIP(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.PersistentIP = true
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.ip(td.IPID) == nil {
+		t.Error("Expecting a persistent IP to be kept")
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	if _, err := td.GetIP(); err == nil {
+		t.Error("Expecting GetIP to fail before Create")
+	}
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := f.addIP()
+	f.mu.Lock()
+	f.attachIP(f.servers[td.ServerID], ip)
+	f.mu.Unlock()
+
+	actual, err := td.GetIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != ip.Address || td.IPAddress != ip.Address {
+		t.Errorf("Expecting '%s', got '%s'\n", ip.Address, actual)
+	}
+
+	url, err := td.GetURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "tcp://" + ip.Address + ":2376"; url != expected {
+		t.Errorf("Expecting '%s', got '%s'\n", expected, url)
+	}
+}
+
+func TestCreatePrivateAddress(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	var probed []string
+	probeSSH = func(addr string) error {
+		probed = append(probed, addr)
+		return nil
+	}
+
+	td := f.newDriver()
+	td.PrivateAddress = true
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := f.server(td.ServerID)
+	if server.PublicAddress.IP != "" || td.IPID != "" || td.IPCreated {
+		t.Errorf("Expecting the server to have no public IP, got '%s'\n", server.PublicAddress.IP)
+	}
+
+	for _, res := range f.resources() {
+		if strings.HasPrefix(res, "ip ") {
+			t.Errorf("Expecting no IP to be reserved, got %s\n", res)
+		}
+	}
+
+	previous := ""
+	for _, step := range []struct {
+		name   string
+		action func() error
+	}{
+		{"Create", func() error { return nil }},
+		{"Start", func() error {
+			if err := td.Stop(); err != nil {
+				return err
+			}
+			return td.Start()
+		}},
+		{"Restart", td.Restart},
+	} {
+		if err := step.action(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		private := f.server(td.ServerID).PrivateIP
+		if private == "" || private == previous {
+			t.Errorf("%s: expecting a new private IP, got '%s'\n", step.name, private)
+		}
+		previous = private
+
+		if td.IPAddress != private {
+			t.Errorf("%s: expecting '%s' to be stored, got '%s'\n", step.name, private, td.IPAddress)
+		}
+
+		if addr := probed[len(probed)-1]; addr != private+":22" {
+			t.Errorf("%s: expecting SSH to be probed on '%s:22', got '%s'\n", step.name, private, addr)
+		}
+
+		url, err := td.GetURL()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := "tcp://" + private + ":2376"; url != expected {
+			t.Errorf("%s: expecting '%s', got '%s'\n", step.name, expected, url)
+		}
+	}
+}
+
+func TestPrivateAddressFlags(t *testing.T) {
+	td := NewDriver(testMachineName, testStorePath)
+	err := td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{
+			"scaleway-organization":        testOrganization,
+			"scaleway-token":               testToken,
+			"scaleway-use-private-address": true,
+			"scaleway-persistent-ip":       true,
+		},
+	})
+
+	if err == nil {
+		t.Error("Expecting --scaleway-use-private-address to exclude --scaleway-persistent-ip")
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	for _, key := range []string{
+		"POST /security_groups/{id}/rules",
+		"POST /ips",
+		"POST /volumes",
+		"POST /servers",
+		"PATCH /servers/{id}",
+		"PATCH /servers/{id}/user_data/role",
+		"POST /servers/{id}/action",
+		"GET /servers/{id}",
+	} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		td.CreateSecurityGroup = true
+		td.Volumes = "10G"
+		td.UserdataEntries = []string{"role=worker"}
+
+		f.failNext(key, http.StatusBadRequest)
+		if err := td.Create(); err == nil {
+			t.Errorf("Expecting Create to fail on '%s'\n", key)
+		}
+
+		if res := f.resources(); len(res) > 0 {
+			t.Errorf("Expecting Create to remove everything after failing on '%s', got %v\n", key, res)
+		}
+
+		if td.ServerID != "" || td.IPID != "" || td.SecurityGroupID != "" {
+			t.Errorf("Expecting the driver state to be cleared after failing on '%s'\n", key)
+		}
+
+		f.close()
+	}
+}
+
+func TestCreateFailureKeepsReservedIP(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	ip := f.addIP()
+
+	td := f.newDriver()
+	td.IPID = ip.ID
+
+	f.failNext("POST /servers/{id}/action", http.StatusInternalServerError)
+	if err := td.Create(); err == nil {
+		t.Fatal("Expecting Create to fail")
+	}
+
+	if res := f.resources(); len(res) != 1 || res[0] != "ip "+ip.ID {
+		t.Errorf("Expecting only the reserved IP to remain, got %v", res)
+	}
+}
+
+func TestCreateKeepOnFailure(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.KeepOnFailure = true
+
+	f.failNext("POST /servers/{id}/action", http.StatusInternalServerError)
+	if err := td.Create(); err == nil {
+		t.Fatal("Expecting Create to fail")
+	}
+
+	if f.server(td.ServerID) == nil {
+		t.Error("Expecting the server to be kept")
+	}
+
+	if f.ip(td.IPID) == nil {
+		t.Error("Expecting the IP to be kept")
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateTimeout(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	probeSSH = func(addr string) error { return errors.New("connection refused") }
+
+	td := f.newDriver()
+	td.CreateTimeout = 1
+	err := td.Create()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expecting Create to time out, got %v", err)
+	}
+
+	if res := f.resources(); len(res) > 0 {
+		t.Errorf("Expecting Create to remove everything after timing out, got %v\n", res)
+	}
+}
+
+func TestPreCreateCheckInvalidToken(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.Token = testReservedIPID
+
+	if err := td.PreCreateCheck(); err == nil {
+		t.Error("Expecting PreCreateCheck to reject the token")
+	}
+}
+
+func TestPreCreateCheckServerConfig(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	arm := f.addImage("ubuntu-arm", "arm", true)
+	mine := f.addImage("my-image", testArch, false)
+
+	for _, tc := range []struct {
+		commercialType string
+		image          string
+		region         string
+		expected       string
+	}{
+		{"vc1s", defaultImage, defaultRegion, ""},
+		{"X64-4GB", defaultImage, defaultRegion, ""},
+		{"C1", "ubuntu-arm", defaultRegion, ""},
+		{"VC1S", "my-image", defaultRegion, ""},
+		{"VC1S", mine.Identifier, defaultRegion, ""},
+		{"VC1X", defaultImage, defaultRegion, "did you mean VC1M or VC1S?"},
+		{"VC1S", "ubuntu-xenail", defaultRegion, "did you mean ubuntu-xenial?"},
+		{"VC1S", "ubuntu-arm", defaultRegion, "no image ubuntu-arm for x86_64"},
+		{"VC1S", arm.Identifier, defaultRegion, "built for arm"},
+		{"VC1S", testReservedIPID, defaultRegion, "no image with id"},
+		{"VC1S", defaultImage, "ams2", "did you mean ams1?"},
+	} {
+		td := f.newDriver()
+		td.CommercialType = tc.commercialType
+		td.Image = tc.image
+		td.Region = tc.region
+
+		err := td.PreCreateCheck()
+		if tc.expected == "" && err != nil {
+			t.Errorf("Expecting %s/%s/%s to be valid, got %v\n", tc.commercialType, tc.image, tc.region, err)
+		}
+
+		if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+			t.Errorf("Expecting %s/%s/%s to fail with '%s', got %v\n", tc.commercialType, tc.image, tc.region, tc.expected, err)
+		}
+	}
+}
+
+func TestPreCreateCheckBootscript(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	f.addImage("ubuntu-arm", "arm", true)
+
+	for _, instance := range []bool{false, true} {
+		for _, tc := range []struct {
+			commercialType string
+			bootscript     string
+			expected       string
+		}{
+			{"VC1S", testBootscript, ""},
+			{"VC1S", testBootscriptID, ""},
+			{"C1", testArmBootscript, ""},
+			{"VC1S", testArmBootscript, "built for arm, but the commercial type VC1S runs x86_64"},
+			{"VC1S", testArmBootscriptID, "built for arm"},
+			{"C1", testBootscriptID, "built for x86_64"},
+			{"VC1S", "x86_64 mainline 4.14.4 rev2", "did you mean " + testBootscript + "?"},
+			{"VC1S", testReservedIPID, "no bootscript with id"},
+		} {
+			td := f.newDriver()
+			if instance {
+				td = f.newInstanceDriver(defaultZone)
+			}
+			td.CommercialType = tc.commercialType
+			td.Bootscript = tc.bootscript
+			if tc.commercialType == "C1" {
+				td.Image = "ubuntu-arm"
+			}
+
+			err := td.PreCreateCheck()
+			if tc.expected == "" && err != nil {
+				t.Errorf("Expecting %s/%s to be valid, got %v\n", tc.commercialType, tc.bootscript, err)
+			}
+
+			if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+				t.Errorf("Expecting %s/%s to fail with '%s', got %v\n", tc.commercialType, tc.bootscript, tc.expected, err)
+			}
+		}
+	}
+}
+
+func TestBootFlags(t *testing.T) {
+	for _, tc := range []struct {
+		flags map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{"scaleway-bootscript": testBootscript}, true},
+		{map[string]interface{}{"scaleway-local-boot": true, "scaleway-secret-key": testToken, "scaleway-access-key": testAccessKey, "scaleway-project-id": testProjectID}, true},
+		{map[string]interface{}{"scaleway-local-boot": true}, false},
+		{map[string]interface{}{"scaleway-local-boot": true, "scaleway-bootscript": testBootscript}, false},
+	} {
+		if tc.flags["scaleway-secret-key"] == nil {
+			tc.flags["scaleway-organization"] = testOrganization
+			tc.flags["scaleway-token"] = testToken
+		}
+
+		td := NewDriver(testMachineName, testStorePath)
+		err := td.SetConfigFromFlags(&commandstest.FakeFlagger{Data: tc.flags})
+		if (err == nil) != tc.valid {
+			t.Errorf("Expecting %v to be valid: %v, got '%v'\n", tc.flags, tc.valid, err)
+		}
+	}
+}
+
+func TestCreateWithBootscript(t *testing.T) {
+	for _, instance := range []bool{false, true} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		if instance {
+			td = f.newInstanceDriver(defaultZone)
+		}
+		td.Bootscript = testBootscript
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := f.server(td.ServerID).Bootscript; b == nil || b.Identifier != testBootscriptID {
+			t.Errorf("Expecting the server to boot %s, got %v\n", testBootscriptID, b)
+		}
+
+		if instance && f.bootTypes[td.ServerID] != "bootscript" {
+			t.Errorf("Expecting the bootscript boot type, got '%s'\n", f.bootTypes[td.ServerID])
+		}
+
+		f.close()
+	}
+}
+
+func TestCreateWithLocalBoot(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newInstanceDriver(defaultZone)
+	td.LocalBoot = true
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bootType := f.bootTypes[td.ServerID]; bootType != "local" {
+		t.Errorf("Expecting the local boot type, got '%s'\n", bootType)
+	}
+}
+
+func TestImageFlags(t *testing.T) {
+	for _, tc := range []struct {
+		flags map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{"scaleway-image-id": testImageID}, true},
+		{map[string]interface{}{"scaleway-image-id": defaultImage}, false},
+		{map[string]interface{}{"scaleway-snapshot": "golden", "scaleway-secret-key": testToken, "scaleway-access-key": testAccessKey, "scaleway-project-id": testProjectID}, true},
+		{map[string]interface{}{"scaleway-snapshot": "golden"}, true},
+		{map[string]interface{}{"scaleway-snapshot": "golden", "scaleway-image-id": testImageID, "scaleway-secret-key": testToken, "scaleway-access-key": testAccessKey, "scaleway-project-id": testProjectID}, false},
+	} {
+		if tc.flags["scaleway-secret-key"] == nil {
+			tc.flags["scaleway-organization"] = testOrganization
+			tc.flags["scaleway-token"] = testToken
+		}
+
+		td := NewDriver(testMachineName, testStorePath)
+		err := td.SetConfigFromFlags(&commandstest.FakeFlagger{Data: tc.flags})
+		if (err == nil) != tc.valid {
+			t.Errorf("Expecting %v to be valid: %v, got '%v'\n", tc.flags, tc.valid, err)
+		}
+	}
+}
+
+func TestPreCreateCheckSnapshot(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	offer := f.products["VC1M"]
+	offer.VolumesConstraint = scw.ProductVolumeConstraint{MinSize: 50000000000, MaxSize: 100000000000}
+	f.products["VC1M"] = offer
+
+	golden := f.addSnapshot("golden", 50000000000)
+	big := f.addSnapshot("big", 150000000000)
+	f.addSnapshot("twin", 50000000000)
+	f.addSnapshot("twin", 50000000000)
+	f.addSnapshot("busy", 50000000000).State = "snapshotting"
+
+	for _, tc := range []struct {
+		snapshot string
+		volumes  string
+		expected string
+	}{
+		{"golden", "", ""},
+		{golden.Identifier, "50G", ""},
+		{"golden", "100G", "makes 150 GB, but the commercial type VC1M takes 50 GB to 100 GB"},
+		{big.Identifier, "", "holds 150 GB"},
+		{"goldne", "", "no snapshot goldne in fr-par-1, did you mean golden?"},
+		{testReservedIPID, "", "no snapshot with id"},
+		{"twin", "", "is ambiguous"},
+		{"busy", "", "is snapshotting"},
+	} {
+		td := f.newInstanceDriver(defaultZone)
+		td.CommercialType = "VC1M"
+		td.Snapshot = tc.snapshot
+		td.Volumes = tc.volumes
+
+		err := td.PreCreateCheck()
+		if tc.expected == "" && err != nil {
+			t.Errorf("Expecting %s/%s to be valid, got %v\n", tc.snapshot, tc.volumes, err)
+		}
+
+		if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+			t.Errorf("Expecting %s/%s to fail with '%s', got %v\n", tc.snapshot, tc.volumes, tc.expected, err)
+		}
+	}
+}
+
+func TestCreateFromSnapshot(t *testing.T) {
+	for _, instance := range []bool{false, true} {
+		f := newFakeAPI()
+		newDriver := f.newDriver
+		if instance {
+			newDriver = func() *Driver { return f.newInstanceDriver(defaultZone) }
+		}
+
+		snapshot := f.addSnapshot("golden", 20000000000)
+
+		td := newDriver()
+		td.Snapshot = snapshot.Name
+		td.Volumes = "10G"
+		if err := td.PreCreateCheck(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		server := f.server(td.ServerID)
+		if server.Image.Identifier != "" {
+			t.Errorf("instance %v: expecting no image, got %s\n", instance, server.Image.Identifier)
+		}
+
+		if root := f.volume(td.RootVolumeID); root == nil || root.Size != snapshot.Size || server.Volumes["0"].Identifier != root.Identifier {
+			t.Errorf("instance %v: expecting a root volume restored from %s, got %v\n", instance, snapshot.Identifier, root)
+		}
+
+		if len(td.VolumeIDs) != 1 || server.Volumes["1"].Identifier != td.VolumeIDs[0] {
+			t.Errorf("instance %v: expecting the additional volume to follow the root one, got %v\n", instance, td.VolumeIDs)
+		}
+
+		if err := td.Remove(); err != nil {
+			t.Fatal(err)
+		}
+
+		if res := f.resources(); len(res) > 0 {
+			t.Errorf("instance %v: expecting Remove to delete everything, got %v\n", instance, res)
+		}
+
+		// A server which cannot be created leaves no restored volume behind.
+		td = newDriver()
+		td.Snapshot = snapshot.Identifier
+		f.failNext("POST /servers", http.StatusBadRequest)
+		if err := td.Create(); err == nil {
+			t.Errorf("instance %v: expecting Create to fail", instance)
+		}
+
+		if res := f.resources(); len(res) > 0 {
+			t.Errorf("instance %v: expecting Create to remove everything, got %v\n", instance, res)
+		}
+
+		f.close()
+	}
+}
+
+func TestCreateBlankRootVolume(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.Image = "20G"
+	if err := td.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := f.server(td.ServerID)
+	if server.Image.Identifier != "" {
+		t.Errorf("Expecting no image, got %s\n", server.Image.Identifier)
+	}
+
+	if root := f.volume(server.Volumes["0"].Identifier); root == nil || root.Size != 20000000000 {
+		t.Errorf("Expecting a blank 20 GB root volume, got %v\n", root)
+	}
+
+	// A server which cannot be created leaves no blank volume behind.
+	td = f.newDriver()
+	td.Image = "20G"
+	f.failNext("POST /servers", http.StatusBadRequest)
+	if err := td.Create(); err == nil {
+		t.Error("Expecting Create to fail")
+	}
+
+	if res := f.resources(); len(res) != 3 {
+		t.Errorf("Expecting only the first server, its IP and its volume, got %v\n", res)
+	}
+}
+
+func TestCreateEnvironmentOverrides(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	arm := f.addImage(defaultImage, "arm", true)
+	f.setenv("SCW_COMMERCIAL_TYPE", "VC1M")
+	f.setenv("SCW_TARGET_ARCH", "arm")
+
+	td := f.newDriver()
+	if err := td.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := f.server(td.ServerID)
+	if server.CommercialType != "VC1M" || server.Image.Identifier != arm.Identifier {
+		t.Errorf("Expecting a VC1M server of the arm image, got %s, %s\n", server.CommercialType, server.Image.Identifier)
+	}
+}
+
+func TestCreateWithImageID(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	golden := f.addImage("golden", testArch, false)
+
+	td := f.newDriver()
+	td.ImageID = golden.Identifier
+	if err := td.PreCreateCheck(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if image := f.server(td.ServerID).Image.Identifier; image != golden.Identifier {
+		t.Errorf("Expecting image %s, got %s\n", golden.Identifier, image)
+	}
+}
+
+func TestPreCreateCheckQuotas(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	f.setQuota("servers", 2)
+	f.setQuota("ips", 2)
+	f.setQuota("volumes", 5)
+
+	td := f.newDriver()
+	td.Volumes = "10G"
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	td = f.newDriver()
+	td.Volumes = "10G"
+	if err := td.PreCreateCheck(); err != nil {
+		t.Errorf("Expecting a second machine to fit, got %v\n", err)
+	}
+
+	td.Volumes = "10G 20G 30G"
+	err := td.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "4 more volumes (2 of 5 used)") {
+		t.Errorf("Expecting the volumes quota to be exceeded, got %v\n", err)
+	}
+
+	f.setQuota("ips", 1)
+	td.Volumes = ""
+	err = td.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "1 more ips (1 of 1 used)") {
+		t.Errorf("Expecting the IPs quota to be exceeded, got %v\n", err)
+	}
+
+	td.IPID = f.addIP().ID
+	if err = td.PreCreateCheck(); err != nil {
+		t.Errorf("Expecting a reserved IP not to count, got %v\n", err)
+	}
+
+	f.setQuota("servers", 1)
+	err = td.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "1 more servers (1 of 1 used)") {
+		t.Errorf("Expecting the servers quota to be exceeded, got %v\n", err)
+	}
+}
+
+func TestPreCreateCheckQuotasOtherRegion(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	// The other region holds an IP and a volume of the organization.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ips":
+			f.reply(w, http.StatusOK, scw.ScalewayGetIPS{IPS: []scw.ScalewayIPDefinition{{ID: "other-ip"}}})
+		case "/volumes":
+			f.reply(w, http.StatusOK, scw.ScalewayVolumes{Volumes: []scw.ScalewayVolume{{Identifier: "other-volume"}}})
+		default:
+			f.reply(w, http.StatusOK, scw.ScalewayServers{})
+		}
+	}))
+	defer other.Close()
+	f.setvar(&scw.ComputeAPIAms1, other.URL)
+
+	f.setQuota("ips", 1)
+	td := f.newDriver()
+	err := td.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "1 more ips (1 of 1 used)") {
+		t.Errorf("Expecting the IP of the other region to count, got %v\n", err)
+	}
+
+	f.setQuota("ips", 2)
+	f.setQuota("volumes", 1)
+	err = td.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "1 more volumes (1 of 1 used)") {
+		t.Errorf("Expecting the volume of the other region to count, got %v\n", err)
+	}
+}
+
+func TestPreCreateCheckQuotasMinSize(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	offer := f.products["VC1M"]
+	offer.VolumesConstraint = scw.ProductVolumeConstraint{MinSize: 300000000000}
+	f.products["VC1M"] = offer
+	f.setQuota("volumes", 2)
+
+	td := f.newDriver()
+	td.CommercialType = "VC1M"
+	err := td.PreCreateCheck()
+	if err == nil || !strings.Contains(err.Error(), "3 more volumes (0 of 2 used)") {
+		t.Errorf("Expecting the volumes filling the offer to count, got %v\n", err)
+	}
+
+	td.Volumes = "250G"
+	if err = td.PreCreateCheck(); err != nil {
+		t.Errorf("Expecting the given volumes to replace the filling, got %v\n", err)
+	}
+}
+
+func TestGetState(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	for scwState, expected := range map[string]state.State{
+		"starting": state.Starting,
+		"running":  state.Running,
+		"stopping": state.Stopping,
+		"stopped":  state.Stopped,
+		"unknown":  state.None,
+	} {
+		f.setServerState(td.ServerID, scwState)
+
+		actual, err := td.GetState()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != expected {
+			t.Errorf("Expecting '%s' for '%s', got '%s'\n", expected, scwState, actual)
+		}
+	}
+
+	f.failNext("GET /servers/{id}", http.StatusForbidden)
+	if actual, err := td.GetState(); err == nil || actual != state.Error {
+		t.Errorf("Expecting '%s' and an error, got '%s'\n", state.Error, actual)
+	}
+}
+
+func TestStopStartRestart(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		action   func() error
+		expected state.State
+	}{
+		{"Stop", td.Stop, state.Stopped},
+		{"Start", td.Start, state.Running},
+		{"Restart", td.Restart, state.Running},
+	}
+
+	for _, step := range steps {
+		if err := step.action(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		actual, err := td.GetState()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != step.expected {
+			t.Errorf("%s: expecting '%s', got '%s'\n", step.name, step.expected, actual)
+		}
+	}
+
+	f.failNext("POST /servers/{id}/action", http.StatusInternalServerError)
+	if err := td.Stop(); err == nil {
+		t.Error("Expecting Stop to fail")
+	}
+}
+
+// recordingClient wraps a machineClient and records the server actions.
+type recordingClient struct {
+	machineClient
+	actions []string
+}
+
+func (c *recordingClient) startServer() error {
+	c.actions = append(c.actions, "start")
+	return c.machineClient.startServer()
+}
+
+func (c *recordingClient) stopServer() error {
+	c.actions = append(c.actions, "stop")
+	return c.machineClient.stopServer()
+}
+
+func (c *recordingClient) rebootServer() error {
+	c.actions = append(c.actions, "reboot")
+	return c.machineClient.rebootServer()
+}
+
+func TestClientFactory(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	rec := &recordingClient{}
+	td := f.newDriver()
+	td.clientFactory = func(d *Driver) (machineClient, error) {
+		c, err := newClient(d)
+		rec.machineClient = c
+		return rec, err
+	}
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []func() error{td.Stop, td.Start, td.Restart} {
+		if err := action(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if actual := strings.Join(rec.actions, " "); actual != "start stop start reboot" {
+		t.Errorf("Expecting 'start stop start reboot', got '%s'\n", actual)
+	}
+
+	expected := errors.New("no client")
+	td.clientFactory = func(d *Driver) (machineClient, error) { return nil, expected }
+	if _, err := td.GetState(); err != expected {
+		t.Errorf("Expecting '%v', got '%v'\n", expected, err)
+	}
+}
+
+func TestKill(t *testing.T) {
+	for _, action := range []string{"poweroff", "stop_in_place"} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		td.KillAction = action
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := td.Kill(); err != nil {
+			t.Fatal(err)
+		}
+
+		if st, err := td.GetState(); err != nil || st != state.Stopped {
+			t.Errorf("%s: expecting the server to be stopped, got %v (%v)\n", action, st, err)
+		}
+
+		if err := td.Kill(); err != nil {
+			t.Errorf("%s: expecting Kill on a stopped server to succeed, got %v\n", action, err)
+		}
+
+		if n := f.count("POST /servers/{id}/action"); n != 2 {
+			t.Errorf("%s: expecting only poweron and %s actions, got %d\n", action, action, n)
+		}
+
+		if err := td.Start(); err != nil {
+			t.Errorf("%s: expecting the server to start again, got %v\n", action, err)
+		}
+
+		f.close()
+	}
+}
+
+func TestKillActionFlag(t *testing.T) {
+	td := NewDriver(testMachineName, testStorePath)
+	err := td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{
+			"scaleway-organization": testOrganization,
+			"scaleway-token":        testToken,
+			"scaleway-kill-action":  "halt",
+		},
+	})
+
+	if err == nil {
+		t.Error("Expecting the kill action to be rejected")
+	}
+
+	if d.KillAction != defaultKillAction {
+		t.Errorf("Expecting the kill action to default to '%s', got '%s'\n", defaultKillAction, d.KillAction)
+	}
+}
+
+func TestKillWithoutStoredAction(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A machine created before the option stores no kill action.
+	td.KillAction = ""
+	if err := td.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err := td.GetState(); err != nil || st != state.Stopped {
+		t.Errorf("Expecting the server to be stopped, got %v (%v)\n", st, err)
+	}
+}
+
+func TestKillFailure(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failNext("POST /servers/{id}/action", http.StatusBadRequest)
+	if err := td.Kill(); err == nil {
+		t.Fatal("Expecting Kill to fail")
+	}
+
+	if f.server(td.ServerID) == nil {
+		t.Error("Expecting the server not to be terminated")
+	}
+}
+
+func TestKillTerminate(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.KillTerminate = true
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failNext("POST /servers/{id}/action", http.StatusBadRequest)
+	if err := td.Kill(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.server(td.ServerID) != nil {
+		t.Error("Expecting the server to be terminated")
+	}
+
+	if st, err := td.GetState(); err != nil || st != state.Stopped {
+		t.Errorf("Expecting the server to be stopped, got %v (%v)\n", st, err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.Volumes = "10G 20G"
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.server(td.ServerID) != nil {
+		t.Errorf("Expecting server '%s' to be removed\n", td.ServerID)
+	}
+
+	if f.ip(td.IPID) != nil {
+		t.Errorf("Expecting IP '%s' to be released\n", td.IPID)
+	}
+
+	if res := f.resources(); len(res) > 0 {
+		t.Errorf("Expecting the volumes to be deleted, got %v\n", res)
+	}
+}
+
+func TestRemoveServerGone(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.Volumes = "10G"
+	td.CreateSecurityGroup = true
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.dropServer(td.ServerID)
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := f.resources(); len(res) > 0 {
+		t.Errorf("Expecting every resource to be removed, got %v\n", res)
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Errorf("Expecting Remove to be idempotent, got %v\n", err)
+	}
+}
+
+func TestRemovePartialFailure(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.Volumes = "10G"
+	td.CreateSecurityGroup = true
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failNext("DELETE /ips/{id}", http.StatusConflict)
+	err := td.Remove()
+	if err == nil || !strings.Contains(err.Error(), "IP "+td.IPAddress) {
+		t.Fatalf("Expecting Remove to report the IP, got %v", err)
+	}
+
+	if res := f.resources(); len(res) != 1 || res[0] != "ip "+td.IPID {
+		t.Errorf("Expecting the other resources to be removed, got %v\n", res)
+	}
+
+	if err = td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := f.resources(); len(res) > 0 {
+		t.Errorf("Expecting a second Remove to finish the job, got %v\n", res)
+	}
+}
+
+func TestRemoveKeepVolumes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keep func(td *Driver)
+		kept func(root string, td *Driver) []string
+	}{
+		{
+			name: "all",
+			keep: func(td *Driver) { td.KeepVolumes = true },
+			kept: func(root string, td *Driver) []string { return append([]string{root}, td.VolumeIDs...) },
+		},
+		{
+			name: "root by index",
+			keep: func(td *Driver) { td.KeptVolumes = []string{"0"} },
+			kept: func(root string, td *Driver) []string { return []string{root} },
+		},
+		{
+			name: "additional by id",
+			keep: func(td *Driver) { td.KeptVolumes = td.VolumeIDs[1:] },
+			kept: func(root string, td *Driver) []string { return td.VolumeIDs[1:] },
+		},
+	} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		td.Volumes = "10G 20G"
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		root := f.server(td.ServerID).Volumes["0"].Identifier
+		tc.keep(td)
+		kept := tc.kept(root, td)
+
+		if err := td.Remove(); err != nil {
+			t.Fatal(err)
+		}
+
+		var expected []string
+		for _, id := range kept {
+			expected = append(expected, "volume "+id)
+		}
+		sort.Strings(expected)
+
+		if res := f.resources(); strings.Join(res, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expecting %v to remain, got %v\n", tc.name, expected, res)
+		}
+
+		for _, id := range kept {
+			if v := f.volume(id); v != nil && v.Server != nil {
+				t.Errorf("%s: expecting volume '%s' to be detached\n", tc.name, id)
+			}
+		}
+
+		f.close()
+	}
+}
+
+func TestSecurityGroupFlags(t *testing.T) {
+	td := NewDriver(testMachineName, testStorePath)
+	err := td.SetConfigFromFlags(&commandstest.FakeFlagger{
+		Data: map[string]interface{}{
+			"scaleway-organization":          testOrganization,
+			"scaleway-token":                 testToken,
+			"scaleway-security-group":        "docker",
+			"scaleway-create-security-group": true,
+		},
+	})
+
+	if err == nil {
+		t.Error("Expecting the security group flags to be mutually exclusive")
+	}
+}
+
+func TestCreateWithSecurityGroup(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	g := f.addGroup("docker")
+
+	for _, needle := range []string{g.Name, g.ID} {
+		td := f.newDriver()
+		td.SecurityGroup = needle
+
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := f.server(td.ServerID).SecurityGroup.Identifier; actual != g.ID {
+			t.Errorf("Expecting '%s', got '%s'\n", g.ID, actual)
+		}
+
+		if err := td.Remove(); err != nil {
+			t.Fatal(err)
+		}
+
+		if f.group(g.ID) == nil {
+			t.Error("Expecting an existing security group to be kept")
+		}
+	}
+
+	td := f.newDriver()
+	td.SecurityGroup = "missing"
+	if err := td.Create(); err == nil {
+		t.Error("Expecting Create to fail on an unknown security group")
+	}
+}
+
+func TestCreateSecurityGroup(t *testing.T) {
+	for _, tc := range []struct {
+		master    bool
+		discovery string
+		expected  string
+	}{
+		{false, "", "[22/TCP 2376/TCP]"},
+		{false, "token://abc", "[22/TCP 2376/TCP 2377/TCP 7946/TCP 7946/UDP 4789/UDP]"},
+		{true, "", "[22/TCP 2376/TCP 2377/TCP 7946/TCP 7946/UDP 4789/UDP 3377/TCP]"},
+	} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		td.CreateSecurityGroup = true
+		td.SwarmMaster = tc.master
+		td.SwarmDiscovery = tc.discovery
+		// docker-machine always sets the default --swarm-host.
+		td.SwarmHost = "tcp://0.0.0.0:3377"
+
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		var ports []string
+		for _, rule := range f.groupRules(td.SecurityGroupID) {
+			ports = append(ports, fmt.Sprintf("%d/%s", rule.DestPortFrom, rule.Protocol))
+		}
+
+		if fmt.Sprint(ports) != tc.expected {
+			t.Errorf("master %v, discovery '%s': expecting '%s', got '%v'\n", tc.master, tc.discovery, tc.expected, ports)
+		}
+
+		f.close()
+	}
+}
+
+func TestCreateSecurityGroupRules(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.CreateSecurityGroup = true
+
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !td.SecurityGroupCreated {
+		t.Fatal("Expecting the security group to be created")
+	}
+
+	g := f.group(td.SecurityGroupID)
+	if g == nil || g.Name != "docker-machine-"+testMachineName {
+		t.Fatalf("Expecting a security group named after the machine, got %v\n", g)
+	}
+
+	if actual := f.server(td.ServerID).SecurityGroup.Identifier; actual != g.ID {
+		t.Errorf("Expecting '%s', got '%s'\n", g.ID, actual)
+	}
+
+	if policy := f.groupPolicy(g.ID); policy != "drop" {
+		t.Errorf("Expecting the inbound traffic to be dropped by default, got '%s'\n", policy)
+	}
+
+	for _, rule := range f.groupRules(g.ID) {
+		if rule.Action != "accept" || rule.Direction != "inbound" {
+			t.Errorf("Expecting an inbound accept rule, got %+v\n", rule)
+		}
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.group(g.ID) != nil {
+		t.Error("Expecting the created security group to be deleted")
+	}
+}
+
+func TestCreateWithUserdata(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	cloudInit := "#cloud-config\npackages:\n  - htop\n"
+	path := filepath.Join(f.dir, "cloud-init.yml")
+	if err := ioutil.WriteFile(path, []byte(cloudInit), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	script := "#!/bin/sh curl -fsS https://example.com/setup | sh"
+	for _, tc := range []struct {
+		userdata, cloudInit string
+	}{
+		{path, cloudInit},
+		{"file://" + path, cloudInit},
+		{"@" + path, cloudInit},
+		{cloudInit, cloudInit},
+		// Inline user data may hold a "/".
+		{script, script},
+	} {
+		td := f.newDriver()
+		td.Userdata = tc.userdata
+		td.UserdataEntries = []string{"monitoring=enabled", "mounts=/data=vol1"}
+
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		data := f.serverUserdata(td.ServerID)
+		expected := map[string]string{
+			"cloud-init": tc.cloudInit,
+			"monitoring": "enabled",
+			"mounts":     "/data=vol1",
+		}
+
+		if len(data) != len(expected) {
+			t.Errorf("Expecting %d user data keys, got %d\n", len(expected), len(data))
+		}
+
+		for key, value := range expected {
+			if string(data[key]) != value {
+				t.Errorf("Expecting '%s' for '%s', got '%s'\n", value, key, data[key])
+			}
+		}
+	}
+}
+
+func TestUserdataValidation(t *testing.T) {
+	for _, tc := range []struct {
+		userdata string
+		entries  []string
+	}{
+		{strings.Repeat("x", maxUserdataSize+1), nil},
+		{"", []string{"big=" + strings.Repeat("x", maxUserdataSize+1)}},
+		{"", []string{"=value"}},
+		{"", []string{"key=a", "key=b"}},
+		{"#cloud-config", []string{"cloud-init=again"}},
+		{"file://./cloud-init.yml", nil},
+		{"@/no/such/user-data", nil},
+		{"@cloud-config.yaml", nil},
+		{os.TempDir(), nil},
+		{"@" + os.TempDir(), nil},
+	} {
+		td := NewDriver(testMachineName, testStorePath).(*Driver)
+		td.Userdata = tc.userdata
+		td.UserdataEntries = tc.entries
+
+		if err := td.PreCreateCheck(); err == nil {
+			t.Errorf("Expecting PreCreateCheck to reject %v\n", tc.entries)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/docker/machine/libmachine/log"
+	scw "github.com/scaleway/scaleway-cli/pkg/api"
+)
+
+// snapshotManifest describes the snapshots --scaleway-snapshot-on-remove took
+// of the volumes of a machine. Only the root volume snapshot is restored by the
+// driver, with --scaleway-snapshot; the manifest lists the others so that they
+// can be found.
+type snapshotManifest struct {
+	Machine        string             `json:"machine"`
+	ServerID       string             `json:"server_id"`
+	CommercialType string             `json:"commercial_type"`
+	Location       string             `json:"location"`
+	Snapshots      []manifestSnapshot `json:"snapshots"`
+}
+
+// manifestSnapshot is the snapshot of the volume at Index on the server, 0
+// being the root volume.
+type manifestSnapshot struct {
+	Index    string `json:"index"`
+	VolumeID string `json:"volume_id"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Size     uint64 `json:"size"`
+}
+
+// snapshotManifestPath returns where the manifest of the machine is written.
+// docker-machine rm deletes the machine directory, so the manifest lives next
+// to it in the store.
+func (d *Driver) snapshotManifestPath() string {
+	return filepath.Join(d.StorePath, "scaleway-snapshots", d.MachineName+".json")
+}
+
+// Commit stops the server, snapshots its root volume and registers an image
+// named name of it, with the architecture and bootscript of the server. It
+// returns the id of the image, which --scaleway-image accepts.
+func (d *Driver) Commit(name string) (string, error) {
+	c, err := d.client()
+	if err != nil {
+		return "", err
+	}
+
+	return c.commitServer(name)
+}
+
+// snapshotVolumes snapshots the volumes of server before its removal, and
+// writes their manifest.
+func (d *Driver) snapshotVolumes(c machineClient, server *scw.ScalewayServer) error {
+	snapshots, err := c.snapshotServer(server, d.MachineName)
+	if err != nil {
+		return err
+	}
+
+	manifest := snapshotManifest{
+		Machine:        d.MachineName,
+		ServerID:       server.Identifier,
+		CommercialType: server.CommercialType,
+		Location:       d.location(),
+	}
+
+	var indexes []string
+	for idx := range snapshots {
+		indexes = append(indexes, idx)
+	}
+	sort.Strings(indexes)
+
+	for _, idx := range indexes {
+		s := snapshots[idx]
+		log.Infof("Volume %s is saved as snapshot %s (%s)", server.Volumes[idx].Identifier, s.Identifier, s.Name)
+		manifest.Snapshots = append(manifest.Snapshots, manifestSnapshot{
+			Index:    idx,
+			VolumeID: server.Volumes[idx].Identifier,
+			ID:       s.Identifier,
+			Name:     s.Name,
+			Size:     s.Size,
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := d.snapshotManifestPath()
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	log.Infof("Wrote the snapshot manifest %s", path)
+	return nil
+}
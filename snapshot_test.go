@@ -0,0 +1,164 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestSnapshotOnRemove(t *testing.T) {
+	for _, instance := range []bool{false, true} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		if instance {
+			td = f.newInstanceDriver(defaultZone)
+		}
+		td.Volumes = "10G"
+		td.SnapshotOnRemove = true
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		serverID, rootID := td.ServerID, td.RootVolumeID
+		if err := td.Remove(); err != nil {
+			t.Fatal(err)
+		}
+
+		if res := f.resources(); len(res) > 0 {
+			t.Errorf("Expecting Remove to delete everything, got %v\n", res)
+		}
+
+		data, err := ioutil.ReadFile(td.snapshotManifestPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var manifest snapshotManifest
+		if err = json.Unmarshal(data, &manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		if manifest.Machine != testMachineName || manifest.ServerID != serverID || len(manifest.Snapshots) != 2 {
+			t.Fatalf("Expecting the manifest of the 2 volumes of %s, got %+v\n", serverID, manifest)
+		}
+
+		for i, s := range manifest.Snapshots {
+			snapshot := f.snapshots[s.ID]
+			if snapshot == nil || snapshot.State != "available" || snapshot.Name != testMachineName+"-"+s.Index || s.Index != []string{"0", "1"}[i] {
+				t.Errorf("Expecting an available snapshot of volume %s, got %+v\n", s.Index, snapshot)
+			}
+		}
+
+		if root := manifest.Snapshots[0]; root.VolumeID != rootID || root.Size != 50000000000 {
+			t.Errorf("Expecting the root volume %s first, got %+v\n", rootID, root)
+		}
+
+		// The root snapshot restores the machine.
+		if instance {
+			td = f.newInstanceDriver(defaultZone)
+			td.Snapshot = manifest.Snapshots[0].ID
+			if err = td.Create(); err != nil {
+				t.Fatal(err)
+			}
+
+			if root := f.volume(td.RootVolumeID); root.Size != manifest.Snapshots[0].Size {
+				t.Errorf("Expecting the root volume to be restored, got %+v\n", root)
+			}
+		}
+
+		f.close()
+	}
+}
+
+func TestSnapshotOnRemoveFailure(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	td.SnapshotOnRemove = true
+	if err := td.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failNext("POST /snapshots", http.StatusBadRequest)
+	if err := td.Remove(); err == nil {
+		t.Error("Expecting Remove to fail")
+	}
+
+	if f.server(td.ServerID) == nil || f.volume(td.RootVolumeID) == nil {
+		t.Error("Expecting the server and its volumes to be kept")
+	}
+
+	if _, err := os.Stat(td.snapshotManifestPath()); !os.IsNotExist(err) {
+		t.Errorf("Expecting no manifest, got %v\n", err)
+	}
+
+	if err := td.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.snapshots) != 1 {
+		t.Errorf("Expecting one snapshot, got %d\n", len(f.snapshots))
+	}
+}
+
+func TestCommit(t *testing.T) {
+	for _, instance := range []bool{false, true} {
+		f := newFakeAPI()
+
+		td := f.newDriver()
+		if instance {
+			td = f.newInstanceDriver(defaultZone)
+		}
+		td.Bootscript = testBootscript
+		td.Volumes = "10G"
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := td.Commit("golden")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state := f.server(td.ServerID).State; state != "stopped" {
+			t.Errorf("Expecting the server to be stopped, got %s\n", state)
+		}
+
+		img := f.images[id]
+		if img == nil || img.Name != "golden" || img.Arch != testArch {
+			t.Fatalf("Expecting a golden %s image, got %+v\n", testArch, img)
+		}
+
+		if img.DefaultBootscript == nil || img.DefaultBootscript.Identifier != testBootscriptID {
+			t.Errorf("Expecting the bootscript of the server, got %v\n", img.DefaultBootscript)
+		}
+
+		// Only the root volume is committed.
+		if len(f.snapshots) != 1 || f.snapshots[img.RootVolume.Identifier].BaseVolume.Identifier != td.RootVolumeID {
+			t.Errorf("Expecting a snapshot of the root volume %s, got %v\n", td.RootVolumeID, f.snapshots)
+		}
+
+		td = f.newDriver()
+		if instance {
+			td = f.newInstanceDriver(defaultZone)
+		}
+		td.Image = id
+		if err = td.PreCreateCheck(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		if image := f.server(td.ServerID).Image.Identifier; image != id {
+			t.Errorf("Expecting image %s, got %s\n", id, image)
+		}
+
+		f.close()
+	}
+}
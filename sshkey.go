@@ -0,0 +1,120 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// readSSHKey parses the private key of --scaleway-ssh-key, which must be an
+// unencrypted RSA or ed25519 key.
+func readSSHKey(path string) ([]byte, ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot use the SSH key %s: %v", path, err)
+	}
+
+	switch t := signer.PublicKey().Type(); t {
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoED25519:
+	default:
+		return nil, nil, fmt.Errorf("cannot use the SSH key %s: %s keys are not supported, expecting RSA or ed25519", path, t)
+	}
+
+	return data, signer, nil
+}
+
+// copySSHKey copies the private key of --scaleway-ssh-key to the machine
+// directory, along with its public key, which it returns.
+func (d *Driver) copySSHKey() (string, error) {
+	data, signer, err := readSSHKey(d.SSHKey)
+	if err != nil {
+		return "", err
+	}
+
+	if err = ioutil.WriteFile(d.GetSSHKeyPath(), data, 0600); err != nil {
+		return "", err
+	}
+
+	pub := ssh.MarshalAuthorizedKey(signer.PublicKey())
+	if err = ioutil.WriteFile(d.publicSSHKeyPath(), pub, 0644); err != nil {
+		return "", err
+	}
+
+	return string(pub), nil
+}
+
+// sameSSHKey tells whether two authorized keys lines hold the same key,
+// whatever their comments.
+func sameSSHKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
+
+// lockSSHKeys takes the lock serializing the updates of the SSH keys of the
+// account between the machines of the store, and returns the function
+// releasing it.
+func (d *Driver) lockSSHKeys() (func(), error) {
+	if d.StorePath == "" {
+		return func() {}, nil
+	}
+
+	return lockFile(filepath.Join(d.StorePath, "scaleway-ssh-keys"))
+}
+
+// sshKeyOwners returns the other machines of the store which own the public
+// key pub on the account: those which registered it, or reused it while
+// another machine owned it. The last owner removes the key.
+func (d *Driver) sshKeyOwners(pub string) []string {
+	if d.StorePath == "" {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(d.StorePath, "machines", "*", "config.json"))
+	if err != nil {
+		return nil
+	}
+
+	var owners []string
+	for _, path := range paths {
+		name := filepath.Base(filepath.Dir(path))
+		if name == d.MachineName {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var host struct {
+			DriverName string
+			Driver     struct {
+				SSHKeyPath       string
+				SSHKeyRegistered bool
+			}
+		}
+		if json.Unmarshal(data, &host) != nil || host.DriverName != "scaleway" || !host.Driver.SSHKeyRegistered {
+			continue
+		}
+
+		key := host.Driver.SSHKeyPath
+		if key == "" {
+			key = filepath.Join(filepath.Dir(path), "id_rsa")
+		}
+
+		if other, err := ioutil.ReadFile(key + ".pub"); err == nil && sameSSHKey(string(other), pub) {
+			owners = append(owners, name)
+		}
+	}
+
+	return owners
+}
@@ -0,0 +1,181 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// tokenSources lists where the API secret, the token or the secret key, comes
+// from. With "config" it is stored in the machine configuration; the others
+// resolve it at runtime, and the configuration only holds the reference.
+var tokenSources = []string{"config", "env", "profile", "command"}
+
+// runtimeToken tells whether the API secret is kept out of the stored
+// configuration.
+func (d *Driver) runtimeToken() bool {
+	return d.TokenSource != "" && d.TokenSource != "config"
+}
+
+// resolveToken sets the API secret from the source the configuration refers
+// to, unless it is already known. The secret is the secret key of the Instance
+// API when an access key is configured, and the token of the legacy API
+// otherwise.
+func (d *Driver) resolveToken() error {
+	if !d.runtimeToken() || d.Token != "" || d.SecretKey != "" {
+		return nil
+	}
+
+	secret, err := d.lookupToken()
+	if err != nil {
+		return err
+	}
+
+	if secret == "" {
+		return fmt.Errorf("cannot find the API secret in the %s token source", d.TokenSource)
+	}
+
+	if d.AccessKey != "" {
+		d.SecretKey = secret
+	} else {
+		d.Token = secret
+	}
+
+	return nil
+}
+
+// lookupToken reads the API secret from the token source.
+func (d *Driver) lookupToken() (string, error) {
+	switch d.TokenSource {
+	case "env":
+		if d.AccessKey != "" {
+			return os.Getenv("SCALEWAY_SECRET_KEY"), nil
+		}
+		return os.Getenv("SCALEWAY_TOKEN"), nil
+	case "profile":
+		p, err := readProfile(d.Profile)
+		if err != nil {
+			return "", err
+		}
+		if d.AccessKey != "" {
+			return p.SecretKey, nil
+		}
+		return p.Token, nil
+	case "command":
+		out, err := exec.Command("sh", "-c", d.TokenCommand).Output()
+		if err != nil {
+			if e, ok := err.(*exec.ExitError); ok && len(e.Stderr) > 0 {
+				err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(e.Stderr)))
+			}
+			return "", fmt.Errorf("cannot run the token command: %v", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	return "", fmt.Errorf("unknown token source %s", d.TokenSource)
+}
+
+// driverConfig has the fields of Driver without its JSON methods.
+type driverConfig Driver
+
+// MarshalJSON leaves the API secret out of the stored configuration when it is
+// resolved at runtime.
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	c := driverConfig(*d)
+	if d.runtimeToken() {
+		c.Token, c.SecretKey = "", ""
+	}
+
+	return json.Marshal(&c)
+}
+
+// UnmarshalJSON loads a stored configuration, then scrubs the API secret
+// stored by earlier versions of the driver.
+func (d *Driver) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*driverConfig)(d)); err != nil {
+		return err
+	}
+
+	if d.migrateToken() {
+		if err := d.scrubConfig(); err != nil {
+			log.Debugf("Cannot scrub the API secret from the machine configuration: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// migrateToken reports whether the stored configuration holds the API secret
+// although --scaleway-token-source resolves it at runtime, and must be
+// rewritten without it. A configuration without an explicit token source keeps
+// its secret, even when the environment or the profile provides it as well.
+func (d *Driver) migrateToken() bool {
+	stored := d.Token
+	if d.AccessKey != "" {
+		stored = d.SecretKey
+	}
+
+	if stored == "" || !d.runtimeToken() {
+		return false
+	}
+
+	log.Infof("Removing the API secret of %s from its configuration, the %s token source provides it", d.MachineName, d.TokenSource)
+
+	return true
+}
+
+// scrubConfig rewrites the driver section of the stored host configuration,
+// without the API secret.
+func (d *Driver) scrubConfig() error {
+	if d.BaseDriver == nil || d.StorePath == "" || d.MachineName == "" {
+		return nil
+	}
+
+	path := d.ResolveStorePath("config.json")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var host map[string]json.RawMessage
+	if err = json.Unmarshal(data, &host); err != nil {
+		return err
+	}
+
+	if _, ok := host["Driver"]; !ok {
+		return nil
+	}
+
+	if host["Driver"], err = d.MarshalJSON(); err != nil {
+		return err
+	}
+
+	if data, err = json.MarshalIndent(host, "", "    "); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "config.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,169 @@
+package scaleway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/commands/commandstest"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// reload round-trips the driver through its stored configuration, like
+// libmachine does between two commands.
+func reload(t *testing.T, td *Driver) *Driver {
+	data, err := json.Marshal(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewDriver("", "").(*Driver)
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	return loaded
+}
+
+func TestTokenSourceFlags(t *testing.T) {
+	for _, tc := range []struct {
+		flags map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{"scaleway-token-source": "env"}, true},
+		{map[string]interface{}{"scaleway-token-source": "vault"}, false},
+		{map[string]interface{}{"scaleway-token-source": "command"}, false},
+		{map[string]interface{}{"scaleway-token-command": "echo " + testToken, "scaleway-token": ""}, true},
+		{map[string]interface{}{"scaleway-token-command": "exit 1", "scaleway-token": ""}, false},
+	} {
+		tc.flags["scaleway-organization"] = testOrganization
+		if _, ok := tc.flags["scaleway-token"]; !ok {
+			tc.flags["scaleway-token"] = testToken
+		}
+
+		td := NewDriver(testMachineName, testStorePath).(*Driver)
+		err := td.SetConfigFromFlags(&commandstest.FakeFlagger{Data: tc.flags})
+
+		if (err == nil) != tc.valid {
+			t.Errorf("Expecting %v to be valid: %v, got '%v'\n", tc.flags, tc.valid, err)
+		}
+
+		if err == nil && td.Token != testToken {
+			t.Errorf("Expecting '%s', got '%s'\n", testToken, td.Token)
+		}
+	}
+}
+
+func TestTokenNotStored(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	for _, source := range []string{"env", "command"} {
+		td := f.newDriver()
+		td.TokenSource = source
+		if source == "command" {
+			secret := filepath.Join(f.dir, "secret")
+			writeFile(t, secret, f.token+"\n")
+			td.TokenCommand = "cat " + secret
+		}
+
+		if err := td.Create(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := json.Marshal(td)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(data), f.token) {
+			t.Errorf("%s: expecting the token not to be stored, got %s\n", source, data)
+		}
+
+		loaded := reload(t, td)
+		if source == "env" {
+			if _, err := loaded.GetState(); err == nil {
+				t.Error("env: expecting a missing SCALEWAY_TOKEN to be reported")
+			}
+			f.setenv("SCALEWAY_TOKEN", f.token)
+		}
+
+		if st, err := loaded.GetState(); err != nil || st != state.Running {
+			t.Errorf("%s: expecting the token to be resolved, got '%s' (%v)\n", source, st, err)
+		}
+
+		if err := loaded.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTokenMigration(t *testing.T) {
+	f := newFakeAPI()
+	defer f.close()
+
+	td := f.newDriver()
+	driver, err := json.Marshal(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := td.ResolveStorePath("config.json")
+	config := `{"ConfigVersion": 3, "Driver": ` + string(driver) + `, "DriverName": "scaleway"}`
+	writeFile(t, path, config)
+
+	// Without an explicit source, the token stays where it is, even when the
+	// environment provides it.
+	f.setenv("SCALEWAY_TOKEN", f.token)
+	if loaded := reload(t, td); loaded.TokenSource != "" || loaded.Token != f.token {
+		t.Errorf("Expecting the stored token to be kept, got source '%s'\n", loaded.TokenSource)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != config {
+		t.Errorf("Expecting the configuration to be left alone, got %s\n", data)
+	}
+
+	// A configuration holding the token along with a runtime source is
+	// scrubbed.
+	td.TokenSource = "env"
+	if driver, err = json.Marshal((*driverConfig)(td)); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, `{"ConfigVersion": 3, "Driver": `+string(driver)+`, "DriverName": "scaleway"}`)
+
+	loaded := NewDriver("", "").(*Driver)
+	if err = json.Unmarshal(driver, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.TokenSource != "env" || loaded.Token != f.token {
+		t.Errorf("Expecting the env source, got '%s'\n", loaded.TokenSource)
+	}
+
+	if data, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), f.token) || !strings.Contains(string(data), `"DriverName": "scaleway"`) {
+		t.Errorf("Expecting the token to be scrubbed from the configuration, got %s\n", data)
+	}
+
+	os.Unsetenv("SCALEWAY_TOKEN")
+	var host struct{ Driver *Driver }
+	host.Driver = NewDriver("", "").(*Driver)
+	if err = json.Unmarshal(data, &host); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = host.Driver.resolveToken(); err == nil {
+		t.Error("Expecting the scrubbed token to require the environment")
+	}
+}
@@ -0,0 +1,69 @@
+package scaleway
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// The interval between two polls starts at waitMinInterval and doubles after
+// each attempt, up to waitMaxInterval.
+var (
+	waitMinInterval = time.Second
+	waitMaxInterval = 15 * time.Second
+)
+
+// waitFor polls done until it reports true or fails. It gives up once timeout
+// has elapsed, if timeout is positive, or when the process is interrupted.
+func waitFor(what string, timeout time.Duration, done func() (bool, error)) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	interval := waitMinInterval
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-deadline:
+			return fmt.Errorf("timed out after %s waiting for %s", timeout, what)
+		case <-interrupt:
+			return fmt.Errorf("interrupted while waiting for %s", what)
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > waitMaxInterval {
+			interval = waitMaxInterval
+		}
+	}
+}
+
+// pause sleeps for d and reports whether it did so without the process being
+// interrupted.
+func pause(d time.Duration) bool {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	select {
+	case <-interrupt:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,71 @@
+package scaleway
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withWaitIntervals(min, max time.Duration) func() {
+	oldMin, oldMax := waitMinInterval, waitMaxInterval
+	waitMinInterval, waitMaxInterval = min, max
+	return func() { waitMinInterval, waitMaxInterval = oldMin, oldMax }
+}
+
+func TestWaitForBackoff(t *testing.T) {
+	defer withWaitIntervals(10*time.Millisecond, 40*time.Millisecond)()
+
+	var polls []time.Time
+	err := waitFor("test", 0, func() (bool, error) {
+		polls = append(polls, time.Now())
+		return len(polls) == 5, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, min := range []time.Duration{10, 20, 40, 40} {
+		if d := polls[i+1].Sub(polls[i]); d < min*time.Millisecond {
+			t.Errorf("Expecting poll %d to wait at least %dms, waited %s\n", i+1, min, d)
+		}
+	}
+}
+
+func TestWaitForError(t *testing.T) {
+	expected := errors.New("boom")
+
+	if err := waitFor("test", 0, func() (bool, error) { return false, expected }); err != expected {
+		t.Errorf("Expecting '%v', got '%v'\n", expected, err)
+	}
+}
+
+func TestWaitForTimeout(t *testing.T) {
+	defer withWaitIntervals(10*time.Millisecond, 10*time.Millisecond)()
+
+	start := time.Now()
+	err := waitFor("test", 50*time.Millisecond, func() (bool, error) { return false, nil })
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expecting a timeout, got '%v'", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expecting the wait to stop at the deadline, took %s\n", d)
+	}
+}
+
+func TestWaitForInterrupt(t *testing.T) {
+	defer withWaitIntervals(time.Minute, time.Minute)()
+
+	err := waitFor("test", 0, func() (bool, error) {
+		p, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			return false, err
+		}
+		return false, p.Signal(os.Interrupt)
+	})
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("Expecting the wait to be interrupted, got '%v'\n", err)
+	}
+}